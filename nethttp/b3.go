@@ -0,0 +1,99 @@
+//go:build go1.7
+// +build go1.7
+
+package nethttp
+
+import (
+	"net/http"
+	"strings"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// b3SingleHeader is the header of the single header B3 propagation
+// format, see https://github.com/openzipkin/b3-propagation.
+const b3SingleHeader = "b3"
+
+// b3SingleFromHeaders returns the single header B3 value equivalent to the
+// X-B3-* headers in h, and whether h holds a trace and span ID.
+func b3SingleFromHeaders(h http.Header) (string, bool) {
+	traceID, spanID := h.Get("X-B3-TraceId"), h.Get("X-B3-SpanId")
+	if traceID == "" || spanID == "" {
+		return "", false
+	}
+	v := traceID + "-" + spanID
+	var sampling string
+	switch sampled := strings.ToLower(h.Get("X-B3-Sampled")); {
+	case h.Get("X-B3-Flags") == "1":
+		sampling = "d"
+	case sampled == "1" || sampled == "true":
+		sampling = "1"
+	case sampled == "0" || sampled == "false":
+		sampling = "0"
+	}
+	// The parent span ID is only allowed after the sampling state.
+	if sampling != "" {
+		v += "-" + sampling
+		if parentID := h.Get("X-B3-ParentSpanId"); parentID != "" {
+			v += "-" + parentID
+		}
+	}
+	return v, true
+}
+
+// formatB3Single returns the single header B3 value for the context of sp,
+// built by format, or, if format is nil, from the X-B3-* headers injected
+// by the tracer of sp.
+func formatB3Single(sp opentracing.Span, format func(sc opentracing.SpanContext) (string, bool)) (string, bool) {
+	if format != nil {
+		return format(sp.Context())
+	}
+	h := http.Header{}
+	if err := sp.Tracer().Inject(sp.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h)); err != nil {
+		return "", false
+	}
+	return b3SingleFromHeaders(h)
+}
+
+// b3HeadersFromSingle returns the X-B3-* headers equivalent to the single
+// header B3 value v, and whether v is a well formed value holding a trace
+// and span ID.
+func b3HeadersFromSingle(v string) (http.Header, bool) {
+	parts := strings.Split(v, "-")
+	if len(parts) < 2 || len(parts) > 4 {
+		return nil, false
+	}
+	traceID, spanID := parts[0], parts[1]
+	if (len(traceID) != 16 && len(traceID) != 32) || !isHex(traceID) || len(spanID) != 16 || !isHex(spanID) {
+		return nil, false
+	}
+	h := http.Header{}
+	h.Set("X-B3-TraceId", traceID)
+	h.Set("X-B3-SpanId", spanID)
+	if len(parts) > 2 {
+		switch parts[2] {
+		case "d":
+			h.Set("X-B3-Flags", "1")
+		case "1", "0":
+			h.Set("X-B3-Sampled", parts[2])
+		default:
+			return nil, false
+		}
+	}
+	if len(parts) > 3 {
+		if len(parts[3]) != 16 || !isHex(parts[3]) {
+			return nil, false
+		}
+		h.Set("X-B3-ParentSpanId", parts[3])
+	}
+	return h, true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
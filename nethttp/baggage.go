@@ -0,0 +1,29 @@
+//go:build go1.7
+// +build go1.7
+
+package nethttp
+
+import (
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// tagBaggage sets a tag prefix+key for every baggage item of sp. Tracers
+// that do not support iterating the baggage, eg by panicking, are
+// tolerated and yield no tags.
+func tagBaggage(sp opentracing.Span, prefix string) {
+	items := map[string]string{}
+	func() {
+		defer func() {
+			_ = recover()
+		}()
+		sp.Context().ForeachBaggageItem(func(k, v string) bool {
+			items[k] = v
+			return true
+		})
+	}()
+	// Tags are set once the iteration is over, as tracers may hold a lock
+	// on the span context while iterating.
+	for k, v := range items {
+		sp.SetTag(prefix+k, v)
+	}
+}
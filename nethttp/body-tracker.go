@@ -0,0 +1,136 @@
+//go:build go1.8
+// +build go1.8
+
+package nethttp
+
+import (
+	"encoding/hex"
+	"hash"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countingBody counts the bytes read through it.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+// requestBodyTracker counts the bytes sent in a client request body.
+// Every body handed out by wrap starts a new attempt, so when the
+// transport replays the body through GetBody only the size of the
+// attempt that was actually sent is reported.
+type requestBodyTracker struct {
+	current  *countingBody
+	attempts int
+	mu       sync.Mutex
+}
+
+func (t *requestBodyTracker) wrap(rc io.ReadCloser) io.ReadCloser {
+	b := &countingBody{ReadCloser: rc}
+	t.mu.Lock()
+	t.current = b
+	t.attempts++
+	t.mu.Unlock()
+	return b
+}
+
+// replayed reports whether the body was handed out more than once.
+func (t *requestBodyTracker) replayed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.attempts > 1
+}
+
+func (t *requestBodyTracker) size() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&t.current.n)
+}
+
+// serverRequestBody wraps the body of a server request to observe how
+// the handler reads it, without consuming it on its own. The handler may
+// read the body from another goroutine than the one finishing the span.
+type serverRequestBody struct {
+	io.ReadCloser
+
+	hash      hash.Hash
+	eof       time.Time
+	n         int64
+	hashLimit int64
+	hashed    int64
+	// readTime accumulates the time spent in Read, if timed is set.
+	readTime time.Duration
+	mu       sync.Mutex
+	timed    bool
+}
+
+func (b *serverRequestBody) Read(p []byte) (int, error) {
+	var start time.Time
+	if b.timed {
+		start = time.Now()
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if b.timed {
+		b.readTime += time.Since(start)
+	}
+	b.n += int64(n)
+	if b.hash != nil && b.hashed < b.hashLimit {
+		m := int64(n)
+		if m > b.hashLimit-b.hashed {
+			m = b.hashLimit - b.hashed
+		}
+		b.hash.Write(p[:m]) //nolint:errcheck // hash.Hash never returns an error
+		b.hashed += m
+	}
+	if err == io.EOF && b.eof.IsZero() {
+		b.eof = time.Now()
+	}
+	b.mu.Unlock()
+	return n, err
+}
+
+// size returns the number of bytes read so far.
+func (b *serverRequestBody) size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
+
+// blockedTime returns the time spent in Read so far.
+func (b *serverRequestBody) blockedTime() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.readTime
+}
+
+// readAt returns the time the body was read to the end, and whether it
+// was.
+func (b *serverRequestBody) readAt() (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.eof, !b.eof.IsZero()
+}
+
+// fingerprint returns a short hex digest of the bytes hashed so far, and
+// whether any bytes were hashed.
+func (b *serverRequestBody) fingerprint() (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.hash == nil || b.hashed == 0 {
+		return "", false
+	}
+	return hex.EncodeToString(b.hash.Sum(nil)[:8]), true
+}
@@ -4,11 +4,24 @@
 package nethttp
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptrace"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
@@ -19,10 +32,20 @@ type contextKey int
 
 const (
 	keyTracer contextKey = iota
+	keyHTTP2StreamID
+	keyAcceptTime
+	keyRequestID
+	keyClientOperationName
+	keyServerAddr
+	keyUncompressedSizer
+	keyAttempt
+	keyHandlerError
 )
 
 const defaultComponentName = "net/http"
 
+var requestSizeKey = "http.request_size"
+
 // Transport wraps a RoundTripper. If a request is being traced with
 // Tracer, Transport will inject the current span into the headers,
 // and set HTTP related tags on the span.
@@ -35,10 +58,47 @@ type Transport struct {
 type clientOptions struct {
 	urlTagFunc               func(u *url.URL) string
 	spanObserver             func(span opentracing.Span, r *http.Request)
+	finishOptionsFunc        func() opentracing.FinishOptions
+	beforeRoundTrip          func(span opentracing.Span, r *http.Request)
+	afterRoundTrip           func(span opentracing.Span, resp *http.Response, err error)
+	skipHosts                func(r *http.Request) bool
+	proxyFunc                func(r *http.Request) (*url.URL, error)
+	tenantFunc               func(r *http.Request) string
+	b3Format                 func(sc opentracing.SpanContext) (string, bool)
+	encodeDeadline           func(time.Duration) string
 	operationName            string
 	componentName            string
+	deadlineHeader           string
+	requestIDHeader          string
+	tenantHeader             string
+	binaryHeader             string
+	cacheHeader              string
+	baggagePrefix            string
+	timeout                  time.Duration
+	maxURLLength             int
+	maxHopSpans              int
+	slowSetupFraction        float64
 	disableClientTrace       bool
 	disableInjectSpanContext bool
+	requestSize              bool
+	stripQuery               bool
+	grpcStatus               bool
+	keepOnlyErrors           bool
+	phaseTimings             bool
+	autoFinish               bool
+	userAgentTag             bool
+	redirectTags             bool
+	tlsSpan                  bool
+	connectSpan              bool
+	dnsSpan                  bool
+	headerBytes              bool
+	expectHTTP2              bool
+	b3Single                 bool
+	protoVersion             bool
+	idempotentTag            bool
+	requireParent            bool
+	contentEncoding          bool
+	dnsCoalescedTag          bool
 }
 
 // ClientOption contols the behavior of TraceRequest.
@@ -61,6 +121,25 @@ func URLTagFunc(f func(u *url.URL) string) ClientOption {
 	}
 }
 
+// StripQuery returns a ClientOption that drops the query string from
+// the span's http.url tag. A function set with URLTagFunc takes
+// precedence, regardless of the order of the options.
+func StripQuery() ClientOption {
+	return func(options *clientOptions) {
+		options.stripQuery = true
+	}
+}
+
+// MaxURLLength returns a ClientOption that truncates the span's
+// http.url tag to n runes, appending "..." and setting the
+// http.url_truncated tag when it was truncated. Truncation is applied to
+// the value returned by the http.url tag function, see URLTagFunc.
+func MaxURLLength(n int) ClientOption {
+	return func(options *clientOptions) {
+		options.maxURLLength = n
+	}
+}
+
 // ComponentName returns a ClientOption that sets the component
 // name for the client-side span.
 func ComponentName(componentName string) ClientOption {
@@ -95,9 +174,403 @@ func ClientSpanObserver(f func(span opentracing.Span, r *http.Request)) ClientOp
 	}
 }
 
+// FinishOptionsFunc returns a ClientOption that uses given function f
+// to generate the FinishOptions of each per-request span. Can be used to
+// set an explicit finish time or to attach bulk log records.
+func FinishOptionsFunc(f func() opentracing.FinishOptions) ClientOption {
+	return func(options *clientOptions) {
+		options.finishOptionsFunc = f
+	}
+}
+
+// RequestSize returns a ClientOption that records the number of bytes
+// sent in the request body as the http.request_size tag. When the
+// request body is replayed through GetBody, e.g. because the transport
+// retried the request, only the size of the attempt that was sent last
+// is recorded, and the net/http.body_replayed tag is set to true, which
+// reveals retries that sent a non idempotent request twice.
+func RequestSize() ClientOption {
+	return func(options *clientOptions) {
+		options.requestSize = true
+	}
+}
+
+// ClientDeadlineHeader returns a ClientOption that propagates the
+// deadline of the request context as the header name. The header value is
+// the time remaining until the deadline, formatted by encode, or by
+// time.Duration.String if encode is nil. A deadline that has already
+// passed is sent as 0. Requests without a deadline get no header.
+func ClientDeadlineHeader(name string, encode func(time.Duration) string) ClientOption {
+	if encode == nil {
+		encode = time.Duration.String
+	}
+	return func(options *clientOptions) {
+		options.deadlineHeader = name
+		options.encodeDeadline = encode
+	}
+}
+
+// GRPCStatusFromTrailer returns a ClientOption that records the
+// grpc-status response trailer as the rpc.grpc.status_code tag, and marks
+// the span as failed when the status is not OK. Trailers are only
+// available once the response body has been read to the end, so the
+// status is read when the body is closed.
+func GRPCStatusFromTrailer() ClientOption {
+	return func(options *clientOptions) {
+		options.grpcStatus = true
+	}
+}
+
+// ClientTimeout returns a ClientOption that records timeout as the
+// http.client.timeout_ms tag of each per-request span. Transport cannot
+// see the Timeout of the http.Client that uses it, so the value must be
+// supplied explicitly, typically the same one as the client's:
+//
+//	client := &http.Client{Transport: &nethttp.Transport{}, Timeout: timeout}
+//	req, ht := nethttp.TraceRequest(tracer, req, nethttp.ClientTimeout(timeout))
+func ClientTimeout(timeout time.Duration) ClientOption {
+	return func(options *clientOptions) {
+		options.timeout = timeout
+	}
+}
+
+// RoundTripObserver returns a ClientOption that calls before right
+// before and after right after the underlying RoundTripper handles a
+// request, with the per-request span. after is also called when the
+// request failed, in which case resp is nil. Can be used to set tags that
+// depend on both the request and the response.
+func RoundTripObserver(
+	before func(span opentracing.Span, r *http.Request),
+	after func(span opentracing.Span, resp *http.Response, err error),
+) ClientOption {
+	return func(options *clientOptions) {
+		options.beforeRoundTrip = before
+		options.afterRoundTrip = after
+	}
+}
+
+// ClientPropagateRequestID returns a ClientOption that copies the request
+// ID stored in the request context by the server middleware, see
+// MWGenerateRequestID, into the header headerName of outgoing requests,
+// unless the request already carries that header.
+func ClientPropagateRequestID(headerName string) ClientOption {
+	return func(options *clientOptions) {
+		options.requestIDHeader = headerName
+	}
+}
+
+// InjectBinary returns a ClientOption that injects the span context in
+// the opentracing.Binary format, base64 encoded, into the header
+// headerName. It is independent of InjectSpanContext, which can be used to
+// turn off the standard injection so the context isn't sent twice.
+func InjectBinary(headerName string) ClientOption {
+	return func(options *clientOptions) {
+		options.binaryHeader = headerName
+	}
+}
+
+// ClientInjectB3Single returns a ClientOption that injects the span
+// context into the single "b3" header used by Zipkin and Istio, see
+// https://github.com/openzipkin/b3-propagation. The value is built by
+// format, which reports false if it cannot format the span context. With
+// a nil format, the value is derived from the X-B3-* headers injected by
+// the tracer for the opentracing.HTTPHeaders format, which requires a
+// tracer configured for B3 propagation. Like InjectBinary, it is
+// independent of InjectSpanContext.
+func ClientInjectB3Single(format func(sc opentracing.SpanContext) (string, bool)) ClientOption {
+	return func(options *clientOptions) {
+		options.b3Single = true
+		options.b3Format = format
+	}
+}
+
+// ClientKeepOnlyErrors returns a ClientOption that sets the
+// sampling.priority tag of per-request spans to 0 when the response
+// status code is below 400, asking the tracer to drop spans of successful
+// requests. Spans of failed requests are kept. Whether the span is
+// actually dropped depends on the tracer.
+func ClientKeepOnlyErrors() ClientOption {
+	return func(options *clientOptions) {
+		options.keepOnlyErrors = true
+	}
+}
+
+// PhaseTimings returns a ClientOption that records the time spent
+// resolving the host, connecting and performing the TLS handshake as the
+// net/http.dns_ms, net/http.connect_ms and net/http.tls_ms tags of the
+// per-request span. It also records the time spent getting a connection,
+// including waiting for one from the pool, as net/http.get_conn_ms, the
+// time spent waiting for the server to answer an "Expect: 100-continue"
+// request as net/http.wait_100_continue_ms and the time spent writing the
+// request body as net/http.write_request_ms. Phases are recorded for every
+// redirect hop. Phases that did not happen, e.g. because an idle
+// connection was reused, are omitted. Requires ClientTrace to be enabled.
+func PhaseTimings() ClientOption {
+	return func(options *clientOptions) {
+		options.phaseTimings = true
+	}
+}
+
+// SlowSetupThreshold returns a ClientOption that sets the
+// net/http.setup_slow tag on per-request spans for which resolving the
+// host, connecting and performing the TLS handshake took more than
+// fraction of the total request time. Requires ClientTrace to be enabled.
+func SlowSetupThreshold(fraction float64) ClientOption {
+	return func(options *clientOptions) {
+		options.slowSetupFraction = fraction
+	}
+}
+
+// WithClientOperationName returns a copy of ctx that carries the
+// operation name of the client-side span of requests made with it. The
+// name takes precedence over the one set with OperationName.
+func WithClientOperationName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, keyClientOperationName, name)
+}
+
+// WithAttempt returns a copy of ctx that carries the ordinal n, starting
+// at 1, of the attempt to send a request made with it. A retrying
+// RoundTripper wrapping Transport sets it on every attempt, and Transport
+// records it as the http.request.attempt tag of the per-request span.
+// Requests without an attempt are tagged as attempt 1.
+//
+// Example:
+//
+//	for attempt := 1; attempt <= 3; attempt++ {
+//		resp, err = transport.RoundTrip(req.WithContext(nethttp.WithAttempt(req.Context(), attempt)))
+//		if err == nil {
+//			break
+//		}
+//	}
+func WithAttempt(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, keyAttempt, n)
+}
+
+// ClientUserAgentTag returns a ClientOption that records the User-Agent
+// header of the request as the http.user_agent tag. Requests without a
+// User-Agent header get no tag; note that http.Transport then sends a
+// default User-Agent, which is not visible to this package.
+func ClientUserAgentTag() ClientOption {
+	return func(options *clientOptions) {
+		options.userAgentTag = true
+	}
+}
+
+// RedirectTags returns a ClientOption that records the URL of the
+// previous hop as the http.redirect_from tag of every per-request span
+// created for a redirect, and the number of redirects followed as the
+// http.redirect_count tag of the root span. Together they describe the
+// whole redirect chain.
+func RedirectTags() ClientOption {
+	return func(options *clientOptions) {
+		options.redirectTags = true
+	}
+}
+
+// ClientSkipHosts returns a ClientOption that disables tracing for the
+// requests, including redirects, for which f returns true. They are sent
+// without creating any span or injecting the span context. This is the
+// client counterpart of MWSpanFilter.
+func ClientSkipHosts(f func(r *http.Request) bool) ClientOption {
+	return func(options *clientOptions) {
+		options.skipHosts = f
+	}
+}
+
+// ClientTLSHandshakeSpan returns a ClientOption that models the TLS
+// handshake as a "TLS handshake" child span of the per-request span,
+// tagged with the negotiated tls.version and tls.cipher, and with the
+// protocol negotiated through ALPN, if any, as tls.alpn. Requires
+// ClientTrace to be enabled.
+func ClientTLSHandshakeSpan() ClientOption {
+	return func(options *clientOptions) {
+		options.tlsSpan = true
+	}
+}
+
+// ClientConnectSpan returns a ClientOption that models each connection
+// attempt as a "TCP connect" child span of the per-request span, tagged
+// with the network and addr dialed. Requires ClientTrace to be enabled.
+func ClientConnectSpan() ClientOption {
+	return func(options *clientOptions) {
+		options.connectSpan = true
+	}
+}
+
+// ClientDNSSpan returns a ClientOption that models the host lookup as a
+// "DNS lookup" child span of the per-request span, tagged with the host,
+// the resolved addrs and whether the lookup was coalesced with a
+// concurrent lookup of the same host. Requires ClientTrace to be enabled.
+//
+// Together with ClientConnectSpan and ClientTLSHandshakeSpan, this shows
+// the connection setup as a waterfall. The three options are independent.
+func ClientDNSSpan() ClientOption {
+	return func(options *clientOptions) {
+		options.dnsSpan = true
+	}
+}
+
+// ClientDNSCoalescedTag returns a ClientOption that records whether the
+// host lookup was coalesced with a concurrent lookup of the same host, as
+// the net/http.dns_coalesced tag. Many coalesced lookups point at a DNS
+// thundering herd. Requires ClientTrace to be enabled.
+func ClientDNSCoalescedTag() ClientOption {
+	return func(options *clientOptions) {
+		options.dnsCoalescedTag = true
+	}
+}
+
+// ClientProxyTag returns a ClientOption that records the proxy used for
+// the request as the net/http.proxy tag, without any user info. The
+// proxy chosen by a RoundTripper is not visible to Transport, so it is
+// resolved again with proxy, which should be the Proxy function of the
+// underlying http.Transport. A nil proxy defaults to
+// http.ProxyFromEnvironment, which matches http.DefaultTransport. No tag
+// is set for requests sent directly.
+func ClientProxyTag(proxy func(r *http.Request) (*url.URL, error)) ClientOption {
+	return func(options *clientOptions) {
+		if proxy == nil {
+			proxy = http.ProxyFromEnvironment
+		}
+		options.proxyFunc = proxy
+	}
+}
+
+// ClientTenant returns a ClientOption that propagates the tenant returned
+// by f for each request, both in the header headerName and as the
+// "tenant" baggage item, and records it as the http.tenant tag. Requests
+// for which f returns an empty string are left unchanged. An empty
+// headerName only sets the baggage item and the tag.
+func ClientTenant(f func(r *http.Request) string, headerName string) ClientOption {
+	return func(options *clientOptions) {
+		options.tenantFunc = f
+		options.tenantHeader = headerName
+	}
+}
+
+// ClientHeaderBytes returns a ClientOption that records the size of the
+// request and response headers as the net/http.request_header_bytes and
+// net/http.response_header_bytes tags, to help spot header bloat such as
+// huge cookies. The size is an estimate: the sum of the lengths of the
+// names and values, ignoring separators and headers added by the
+// RoundTripper itself, like Host or User-Agent.
+func ClientHeaderBytes() ClientOption {
+	return func(options *clientOptions) {
+		options.headerBytes = true
+	}
+}
+
+// ClientMaxHopSpans returns a ClientOption that creates per-request spans
+// for at most the first n requests traced by a Tracer, ie the request and
+// its first n-1 redirects. Further redirects are sent without a span, and
+// the http.redirect_spans_truncated tag of the root span is set to true.
+// This bounds the number of spans of a redirect loop.
+func ClientMaxHopSpans(n int) ClientOption {
+	return func(options *clientOptions) {
+		options.maxHopSpans = n
+	}
+}
+
+// ClientExpectHTTP2 returns a ClientOption that declares that requests
+// are expected to use HTTP/2, and records whether a response came over
+// HTTP/1.x instead, eg because ALPN failed or a proxy does not support
+// HTTP/2, as the net/http.h2_downgraded tag.
+func ClientExpectHTTP2() ClientOption {
+	return func(options *clientOptions) {
+		options.expectHTTP2 = true
+	}
+}
+
+// ClientProtoVersionTags returns a ClientOption that records the HTTP
+// version of the response as the integer net/http.proto_major and
+// net/http.proto_minor tags, eg to search for spans with proto_major == 2.
+func ClientProtoVersionTags() ClientOption {
+	return func(options *clientOptions) {
+		options.protoVersion = true
+	}
+}
+
+// ClientIdempotentTag returns a ClientOption that records whether a
+// request is safe to retry as the http.idempotent tag, eg to spot retried
+// POST requests. A request is idempotent if its method is one of the
+// idempotent methods of RFC 9110, section 9.2.2: GET, HEAD, OPTIONS,
+// TRACE, PUT or DELETE, or if it has an Idempotency-Key or
+// X-Idempotency-Key header. Note that net/http only replays the requests
+// with one of these headers or a GET, HEAD, OPTIONS or TRACE method.
+func ClientIdempotentTag() ClientOption {
+	return func(options *clientOptions) {
+		options.idempotentTag = true
+	}
+}
+
+// ClientRequireParent returns a ClientOption that only traces requests
+// that are part of an existing trace, eg to avoid orphan root spans for
+// background jobs. TraceRequest has no explicit parent argument: the
+// parent is the span in the context of the request, see
+// opentracing.ContextWithSpan. If there is none, TraceRequest returns req
+// unchanged, so that no spans are created and no headers are injected,
+// and the returned Tracer's Span method returns nil.
+func ClientRequireParent() ClientOption {
+	return func(options *clientOptions) {
+		options.requireParent = true
+	}
+}
+
+// CacheHeaderTag returns a ClientOption that records whether a response
+// was served by a caching RoundTripper wrapped by Transport, such as
+// httpcache, as the cache.hit tag. A response is a hit if it has the
+// header name, which defaults to "X-From-Cache" when name is empty.
+func CacheHeaderTag(name string) ClientOption {
+	if name == "" {
+		name = "X-From-Cache"
+	}
+	return func(options *clientOptions) {
+		options.cacheHeader = name
+	}
+}
+
+// ClientDumpBaggageTag returns a ClientOption that records every baggage
+// item of the per-request span, as about to be injected into the request,
+// as a tag named prefix followed by the key of the item. This helps
+// verifying that baggage set upstream is propagated. Baggage often
+// carries personal data, so this is meant as a temporary debugging switch.
+// An empty prefix disables the option.
+func ClientDumpBaggageTag(prefix string) ClientOption {
+	return func(options *clientOptions) {
+		options.baggagePrefix = prefix
+	}
+}
+
+// ClientContentEncodingTag returns a ClientOption that records the
+// Content-Encoding of the response as the
+// net/http.response_content_encoding tag. Note that http.Transport
+// transparently decompresses gzip responses to requests it asked
+// compression for itself, and then removes the header; such responses are
+// tagged "gzip(transparent)". Responses without a Content-Encoding get no
+// tag.
+func ClientContentEncodingTag() ClientOption {
+	return func(options *clientOptions) {
+		options.contentEncoding = true
+	}
+}
+
+// ClientAutoFinish returns a ClientOption that finishes the root span
+// together with the per-request span, when the response body is closed or
+// the request fails, so that callers do not need to call Tracer.Finish.
+// The time from the start of the root span to its finish, which includes
+// reading the response body, is recorded as the net/http.total_ms tag.
+// Calling Tracer.Finish anyway is harmless. Since the root span is
+// finished with the first response, redirects should not be followed.
+func ClientAutoFinish() ClientOption {
+	return func(options *clientOptions) {
+		options.autoFinish = true
+	}
+}
+
 // TraceRequest adds a ClientTracer to req, tracing the request and
 // all requests caused due to redirects. When tracing requests this
-// way you must also use Transport.
+// way you must also use Transport. The root span records the URL that
+// served the response, after redirects, as the http.final_url tag.
 //
 // Example:
 //
@@ -121,15 +594,23 @@ func ClientSpanObserver(f func(span opentracing.Span, r *http.Request)) ClientOp
 //	}
 func TraceRequest(tr opentracing.Tracer, req *http.Request, options ...ClientOption) (*http.Request, *Tracer) {
 	opts := &clientOptions{
-		urlTagFunc: func(u *url.URL) string {
-			return u.String()
-		},
 		spanObserver: func(_ opentracing.Span, _ *http.Request) {},
 	}
 	for _, opt := range options {
 		opt(opts)
 	}
+	if opts.urlTagFunc == nil {
+		opts.urlTagFunc = func(u *url.URL) string {
+			return u.String()
+		}
+		if opts.stripQuery {
+			opts.urlTagFunc = urlWithoutQuery
+		}
+	}
 	ht := &Tracer{tr: tr, opts: opts}
+	if opts.requireParent && opentracing.SpanFromContext(req.Context()) == nil {
+		return req, ht
+	}
 	ctx := req.Context()
 	if !opts.disableClientTrace {
 		ctx = httptrace.WithClientTrace(ctx, ht.clientTrace())
@@ -140,25 +621,29 @@ func TraceRequest(tr opentracing.Tracer, req *http.Request, options ...ClientOpt
 
 type closeTracker struct {
 	io.ReadCloser
-	sp opentracing.Span
+	sp   opentracing.Span
+	ht   *Tracer
+	resp *http.Response
 }
 
 func (c closeTracker) Close() error {
 	err := c.ReadCloser.Close()
 	c.sp.LogFields(log.String("event", "ClosedBody"))
-	c.sp.Finish()
+	c.ht.finishSpan(c.sp, c.resp)
 	return err
 }
 
 type writerCloseTracker struct {
 	io.ReadWriteCloser
-	sp opentracing.Span
+	sp   opentracing.Span
+	ht   *Tracer
+	resp *http.Response
 }
 
 func (c writerCloseTracker) Close() error {
 	err := c.ReadWriteCloser.Close()
 	c.sp.LogFields(log.String("event", "ClosedBody"))
-	c.sp.Finish()
+	c.ht.finishSpan(c.sp, c.resp)
 	return err
 }
 
@@ -182,36 +667,159 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if tracer == nil {
 		return rt.RoundTrip(req)
 	}
+	if tracer.opts.skipHosts != nil && tracer.opts.skipHosts(req) {
+		return tracer.skipRoundTrip(rt, req)
+	}
+	if maxHops := tracer.opts.maxHopSpans; maxHops > 0 && tracer.hops >= maxHops {
+		tracer.hops++
+		tracer.root.SetTag("http.redirect_spans_truncated", true)
+		return tracer.skipRoundTrip(rt, req)
+	}
 
 	sp := tracer.start(req)
 
 	ext.HTTPMethod.Set(sp, req.Method)
-	ext.HTTPUrl.Set(sp, tracer.opts.urlTagFunc(req.URL))
+	setURLTag(sp, tracer.opts.urlTagFunc(req.URL), tracer.opts.maxURLLength)
 	ext.PeerAddress.Set(sp, req.URL.Host)
+	attempt, ok := req.Context().Value(keyAttempt).(int)
+	if !ok {
+		attempt = 1
+	}
+	sp.SetTag("http.request.attempt", attempt)
+	if ua := req.Header.Get("User-Agent"); ua != "" && tracer.opts.userAgentTag {
+		sp.SetTag("http.user_agent", ua)
+	}
+	if tracer.opts.proxyFunc != nil {
+		if proxy, err := tracer.opts.proxyFunc(req); err == nil && proxy != nil {
+			u := *proxy
+			u.User = nil
+			sp.SetTag("net/http.proxy", u.String())
+		}
+	}
+	if tracer.opts.timeout > 0 {
+		sp.SetTag("http.client.timeout_ms", tracer.opts.timeout.Milliseconds())
+	}
 	tracer.opts.spanObserver(sp, req)
 
+	if name := tracer.opts.requestIDHeader; name != "" && req.Header.Get(name) == "" {
+		if id := RequestIDFromContext(req.Context()); id != "" {
+			req.Header.Set(name, id)
+		}
+	}
+
+	if tracer.opts.tenantFunc != nil {
+		if tenant := tracer.opts.tenantFunc(req); tenant != "" {
+			if tracer.opts.tenantHeader != "" {
+				req.Header.Set(tracer.opts.tenantHeader, tenant)
+			}
+			sp.SetBaggageItem("tenant", tenant)
+			sp.SetTag("http.tenant", tenant)
+		}
+	}
+
+	if tracer.opts.baggagePrefix != "" {
+		tagBaggage(sp, tracer.opts.baggagePrefix)
+	}
+
+	if tracer.opts.deadlineHeader != "" {
+		if deadline, ok := req.Context().Deadline(); ok {
+			remaining := time.Until(deadline)
+			if remaining < 0 {
+				remaining = 0
+			}
+			req.Header.Set(tracer.opts.deadlineHeader, tracer.opts.encodeDeadline(remaining))
+		}
+	}
+
 	if !tracer.opts.disableInjectSpanContext {
 		carrier := opentracing.HTTPHeadersCarrier(req.Header)
 		sp.Tracer().Inject(sp.Context(), opentracing.HTTPHeaders, carrier) //nolint:errcheck // TODO: should we check the error? Returning it makes the tests fail
 	}
+	if tracer.opts.binaryHeader != "" {
+		var buf bytes.Buffer
+		if err := sp.Tracer().Inject(sp.Context(), opentracing.Binary, &buf); err == nil {
+			req.Header.Set(tracer.opts.binaryHeader, base64.StdEncoding.EncodeToString(buf.Bytes()))
+		}
+	}
+
+	if tracer.opts.b3Single {
+		if b3, ok := formatB3Single(sp, tracer.opts.b3Format); ok {
+			req.Header.Set(b3SingleHeader, b3)
+		}
+	}
+
+	if tracer.opts.requestSize && req.Body != nil && req.Body != http.NoBody {
+		req = tracer.trackRequestBody(req)
+	}
 
+	if tracer.opts.headerBytes {
+		sp.SetTag("net/http.request_header_bytes", headerSize(req.Header))
+	}
+	if tracer.opts.idempotentTag {
+		sp.SetTag("http.idempotent", isIdempotent(req))
+	}
+	if tracer.opts.beforeRoundTrip != nil {
+		tracer.opts.beforeRoundTrip(sp, req)
+	}
 	resp, err := rt.RoundTrip(req)
+	if tracer.opts.afterRoundTrip != nil {
+		tracer.opts.afterRoundTrip(sp, resp, err)
+	}
 	if err != nil {
-		sp.Finish()
+		sp.SetTag("error.type", errorType(err))
+		tracer.finishSpan(sp, nil)
 		return resp, err
 	}
 	ext.HTTPStatusCode.Set(sp, uint16(resp.StatusCode)) //nolint:gosec // can't have integer overflow with status code
+	// http.Transport reports Connection: close as Response.Close, but other
+	// RoundTrippers may not.
+	sp.SetTag("net/http.response_connection_close", resp.Close || hasToken(resp.Header, "Connection", "close"))
+	if tracer.opts.expectHTTP2 {
+		sp.SetTag("net/http.h2_downgraded", resp.ProtoMajor < 2)
+	}
+	if tracer.opts.contentEncoding {
+		encoding := resp.Header.Get("Content-Encoding")
+		if resp.Uncompressed {
+			encoding = "gzip(transparent)"
+		}
+		if encoding != "" {
+			sp.SetTag("net/http.response_content_encoding", encoding)
+		}
+	}
+	if tracer.opts.cacheHeader != "" {
+		sp.SetTag("cache.hit", resp.Header.Get(tracer.opts.cacheHeader) != "")
+	}
+	if tracer.opts.protoVersion {
+		sp.SetTag("net/http.proto_major", resp.ProtoMajor)
+		sp.SetTag("net/http.proto_minor", resp.ProtoMinor)
+	}
+	if tracer.opts.headerBytes {
+		sp.SetTag("net/http.response_header_bytes", headerSize(resp.Header))
+	}
 	if resp.StatusCode >= http.StatusInternalServerError {
 		ext.Error.Set(sp, true)
 	}
+	if tracer.opts.keepOnlyErrors && resp.StatusCode < http.StatusBadRequest {
+		ext.SamplingPriority.Set(sp, 0)
+	}
+	tracer.setFinalURL(req, resp)
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		if location, err := resp.Location(); err == nil {
+			sp.LogFields(
+				log.String("event", "redirect"),
+				log.Int("status", resp.StatusCode),
+				log.String("location", tracer.opts.urlTagFunc(location)),
+			)
+		}
+	}
 	if req.Method == http.MethodHead {
-		sp.Finish()
+		tracer.finishSpan(sp, resp)
 	} else {
 		readWriteCloser, ok := resp.Body.(io.ReadWriteCloser)
 		if ok {
-			resp.Body = writerCloseTracker{readWriteCloser, sp}
+			resp.Body = writerCloseTracker{readWriteCloser, sp, tracer, resp}
 		} else {
-			resp.Body = closeTracker{resp.Body, sp}
+			resp.Body = closeTracker{resp.Body, sp, tracer, resp}
 		}
 	}
 	return resp, nil
@@ -219,10 +827,19 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 // Tracer holds tracing details for one HTTP request.
 type Tracer struct {
-	tr   opentracing.Tracer
-	root opentracing.Span
-	sp   opentracing.Span
-	opts *clientOptions
+	tr      opentracing.Tracer
+	root    opentracing.Span
+	sp      opentracing.Span
+	body    *requestBodyTracker
+	opts    *clientOptions
+	phases  phaseTimings
+	subs    subSpans
+	spStart time.Time
+	// rootStart is the start time of root.
+	rootStart  time.Time
+	lastURL    string
+	finishOnce sync.Once
+	hops       int
 }
 
 func (h *Tracer) start(req *http.Request) opentracing.Span {
@@ -232,16 +849,23 @@ func (h *Tracer) start(req *http.Request) opentracing.Span {
 		if parent != nil {
 			spanctx = parent.Context()
 		}
-		operationName := h.opts.operationName
+		operationName, _ := req.Context().Value(keyClientOperationName).(string)
+		if operationName == "" {
+			operationName = h.opts.operationName
+		}
 		if operationName == "" {
 			operationName = "HTTP Client"
 		}
-		root := h.tr.StartSpan(operationName, opentracing.ChildOf(spanctx))
+		h.rootStart = time.Now()
+		root := h.tr.StartSpan(operationName, opentracing.ChildOf(spanctx), opentracing.StartTime(h.rootStart))
 		h.root = root
 	}
 
+	h.body = nil
+	h.phases.reset()
+	h.spStart = time.Now()
 	ctx := h.root.Context()
-	h.sp = h.tr.StartSpan("HTTP "+req.Method, opentracing.ChildOf(ctx), ext.SpanKindRPCClient)
+	h.sp = h.tr.StartSpan("HTTP "+req.Method, opentracing.ChildOf(ctx), ext.SpanKindRPCClient, opentracing.StartTime(h.spStart))
 
 	componentName := h.opts.componentName
 	if componentName == "" {
@@ -249,14 +873,179 @@ func (h *Tracer) start(req *http.Request) opentracing.Span {
 	}
 	ext.Component.Set(h.sp, componentName)
 
+	if h.opts.redirectTags {
+		if h.hops > 0 {
+			h.sp.SetTag("http.redirect_from", h.lastURL)
+		}
+		h.lastURL = h.opts.urlTagFunc(req.URL)
+	}
+	h.hops++
+
 	return h.sp
 }
 
-// Finish finishes the span of the traced request.
+// hasToken reports whether the comma-separated header name in h contains
+// token, eg "close" in the Connection header.
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isIdempotent reports whether req may be retried, see ClientIdempotentTag.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	for _, name := range []string{"Idempotency-Key", "X-Idempotency-Key"} {
+		if _, ok := req.Header[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// headerSize estimates the size of h on the wire as the sum of the lengths
+// of its names and values.
+func headerSize(h http.Header) int {
+	n := 0
+	for name, values := range h {
+		for _, v := range values {
+			n += len(name) + len(v)
+		}
+	}
+	return n
+}
+
+// skip detaches the httptrace hooks, which are still called for requests
+// that are not traced, from the span of the previous request.
+func (h *Tracer) skip() {
+	h.sp = opentracing.NoopTracer{}.StartSpan("")
+	h.phases.reset()
+}
+
+// skipRoundTrip sends req through rt without a span for its hop. The
+// root span, if an earlier hop started it, still records the URL of the
+// hop as the final URL.
+func (h *Tracer) skipRoundTrip(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	h.skip()
+	resp, err := rt.RoundTrip(req)
+	if err == nil && h.root != nil {
+		h.setFinalURL(req, resp)
+	}
+	return resp, err
+}
+
+// setFinalURL records the URL of the hop that returned resp as the
+// http.final_url tag of the root span. The last hop is the one that
+// served the response once all redirects have been followed.
+func (h *Tracer) setFinalURL(req *http.Request, resp *http.Response) {
+	finalURL := req.URL
+	if resp.Request != nil {
+		finalURL = resp.Request.URL
+	}
+	h.root.SetTag("http.final_url", truncateURL(h.opts.urlTagFunc(finalURL), h.opts.maxURLLength))
+}
+
+// trackRequestBody returns a shallow copy of req whose body, and any body
+// later obtained through GetBody, counts the bytes sent.
+func (h *Tracer) trackRequestBody(req *http.Request) *http.Request {
+	bt := &requestBodyTracker{}
+	r := new(http.Request)
+	*r = *req
+	r.Body = bt.wrap(req.Body)
+	if getBody := req.GetBody; getBody != nil {
+		r.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return bt.wrap(body), nil
+		}
+	}
+	h.body = bt
+	return r
+}
+
+// finishSpan sets the tags that are only known once the request is
+// complete and finishes the per-request span sp. resp is nil when the
+// request failed.
+func (h *Tracer) finishSpan(sp opentracing.Span, resp *http.Response) {
+	if h.body != nil {
+		sp.SetTag(requestSizeKey, int(h.body.size()))
+		if h.body.replayed() {
+			sp.SetTag("net/http.body_replayed", true)
+		}
+	}
+	if h.opts.grpcStatus && resp != nil {
+		if code, err := strconv.Atoi(resp.Trailer.Get("grpc-status")); err == nil {
+			sp.SetTag("rpc.grpc.status_code", code)
+			if code != 0 {
+				ext.Error.Set(sp, true)
+			}
+		}
+	}
+	h.tagPhases(sp)
+	h.subs.finishAll()
+	if h.opts.finishOptionsFunc != nil {
+		sp.FinishWithOptions(h.opts.finishOptionsFunc())
+	} else {
+		sp.Finish()
+	}
+	if h.opts.autoFinish {
+		h.Finish()
+	}
+}
+
+// tagPhases sets the tags derived from the phase timings of the request.
+func (h *Tracer) tagPhases(sp opentracing.Span) {
+	var setup time.Duration
+	for _, phase := range setupPhases {
+		d, ok := h.phases.get(phase)
+		if !ok {
+			continue
+		}
+		setup += d
+		if h.opts.phaseTimings {
+			sp.SetTag("net/http."+phase+"_ms", d.Milliseconds())
+		}
+	}
+	if h.opts.phaseTimings {
+		for _, phase := range requestPhases {
+			if d, ok := h.phases.get(phase); ok {
+				sp.SetTag("net/http."+phase+"_ms", d.Milliseconds())
+			}
+		}
+	}
+	if h.opts.slowSetupFraction > 0 {
+		total := time.Since(h.spStart)
+		if float64(setup) > h.opts.slowSetupFraction*float64(total) {
+			sp.SetTag("net/http.setup_slow", true)
+		}
+	}
+}
+
+// Finish finishes the span of the traced request. Only the first call
+// has an effect.
 func (h *Tracer) Finish() {
-	if h.root != nil {
-		h.root.Finish()
+	if h.root == nil {
+		return
 	}
+	h.finishOnce.Do(func() {
+		if h.opts.redirectTags && h.hops > 1 {
+			h.root.SetTag("http.redirect_count", h.hops-1)
+		}
+		if h.opts.autoFinish {
+			h.root.SetTag("net/http.total_ms", time.Since(h.rootStart).Milliseconds())
+		}
+		h.root.Finish()
+	})
 }
 
 // Span returns the root span of the traced request. This function
@@ -279,14 +1068,18 @@ func (h *Tracer) clientTrace() *httptrace.ClientTrace {
 		WroteHeaders:         h.wroteHeaders,
 		Wait100Continue:      h.wait100Continue,
 		WroteRequest:         h.wroteRequest,
+		TLSHandshakeStart:    h.tlsHandshakeStart,
+		TLSHandshakeDone:     h.tlsHandshakeDone,
 	}
 }
 
 func (h *Tracer) getConn(hostPort string) {
+	h.phases.start(phaseGetConn)
 	h.sp.LogFields(log.String("event", "GetConn"), log.String("hostPort", hostPort))
 }
 
 func (h *Tracer) gotConn(info httptrace.GotConnInfo) {
+	h.phases.done(phaseGetConn)
 	h.sp.SetTag("net/http.reused", info.Reused)
 	h.sp.SetTag("net/http.was_idle", info.WasIdle)
 	h.sp.LogFields(log.String("event", "GotConn"))
@@ -301,17 +1094,31 @@ func (h *Tracer) gotFirstResponseByte() {
 }
 
 func (h *Tracer) got100Continue() {
+	h.phases.done(phaseWait100Continue)
+	// The body is only written once the server agreed to receive it.
+	h.phases.start(phaseWriteRequest)
 	h.sp.LogFields(log.String("event", "Got100Continue"))
 }
 
 func (h *Tracer) dnsStart(info httptrace.DNSStartInfo) {
+	h.phases.start(phaseDNS)
 	h.sp.LogFields(
 		log.String("event", "DNSStart"),
 		log.String("host", info.Host),
 	)
+	if h.opts.dnsSpan {
+		sp := h.subs.start(h.sp, phaseDNS, "DNS lookup")
+		sp.SetTag("host", info.Host)
+	}
 }
 
 func (h *Tracer) dnsDone(info httptrace.DNSDoneInfo) {
+	h.phases.done(phaseDNS)
+	if h.opts.dnsCoalescedTag {
+		// A coalesced lookup shared the result of a concurrent lookup of
+		// the same host.
+		h.sp.SetTag("net/http.dns_coalesced", info.Coalesced)
+	}
 	fields := []log.Field{log.String("event", "DNSDone")}
 	for _, addr := range info.Addrs {
 		fields = append(fields, log.String("addr", addr.String()))
@@ -320,17 +1127,44 @@ func (h *Tracer) dnsDone(info httptrace.DNSDoneInfo) {
 		fields = append(fields, log.Error(info.Err))
 	}
 	h.sp.LogFields(fields...)
+	if sp := h.subs.end(phaseDNS); sp != nil {
+		addrs := make([]string, 0, len(info.Addrs))
+		for _, addr := range info.Addrs {
+			addrs = append(addrs, addr.String())
+		}
+		sp.SetTag("addrs", strings.Join(addrs, ","))
+		sp.SetTag("coalesced", info.Coalesced)
+		if info.Err != nil {
+			ext.Error.Set(sp, true)
+			sp.LogFields(log.String("event", "error"), log.Error(info.Err))
+		}
+		sp.Finish()
+	}
 }
 
 func (h *Tracer) connectStart(network, addr string) {
+	h.phases.start(phaseConnect)
 	h.sp.LogFields(
 		log.String("event", "ConnectStart"),
 		log.String("network", network),
 		log.String("addr", addr),
 	)
+	if h.opts.connectSpan {
+		sp := h.subs.start(h.sp, connectKey(network, addr), "TCP connect")
+		sp.SetTag("network", network)
+		sp.SetTag("addr", addr)
+	}
 }
 
 func (h *Tracer) connectDone(network, addr string, err error) {
+	h.phases.done(phaseConnect)
+	if sp := h.subs.end(connectKey(network, addr)); sp != nil {
+		if err != nil {
+			ext.Error.Set(sp, true)
+			sp.LogFields(log.String("event", "error"), log.Error(err))
+		}
+		sp.Finish()
+	}
 	if err != nil {
 		h.sp.LogFields(
 			log.String("message", "ConnectDone"),
@@ -349,14 +1183,17 @@ func (h *Tracer) connectDone(network, addr string, err error) {
 }
 
 func (h *Tracer) wroteHeaders() {
+	h.phases.start(phaseWriteRequest)
 	h.sp.LogFields(log.String("event", "WroteHeaders"))
 }
 
 func (h *Tracer) wait100Continue() {
+	h.phases.start(phaseWait100Continue)
 	h.sp.LogFields(log.String("event", "Wait100Continue"))
 }
 
 func (h *Tracer) wroteRequest(info httptrace.WroteRequestInfo) {
+	h.phases.done(phaseWriteRequest)
 	if info.Err != nil {
 		h.sp.LogFields(
 			log.String("message", "WroteRequest"),
@@ -368,3 +1205,84 @@ func (h *Tracer) wroteRequest(info httptrace.WroteRequestInfo) {
 		h.sp.LogFields(log.String("event", "WroteRequest"))
 	}
 }
+
+func (h *Tracer) tlsHandshakeStart() {
+	h.phases.start(phaseTLS)
+	h.sp.LogFields(log.String("event", "TLSHandshakeStart"))
+	if h.opts.tlsSpan {
+		h.subs.start(h.sp, phaseTLS, "TLS handshake")
+	}
+}
+
+func (h *Tracer) tlsHandshakeDone(state tls.ConnectionState, err error) {
+	h.phases.done(phaseTLS)
+	if sp := h.subs.end(phaseTLS); sp != nil {
+		if err != nil {
+			ext.Error.Set(sp, true)
+			sp.LogFields(log.String("event", "error"), log.Error(err))
+		} else {
+			sp.SetTag("tls.version", tlsVersionName(state.Version))
+			sp.SetTag("tls.cipher", tls.CipherSuiteName(state.CipherSuite))
+			if state.NegotiatedProtocol != "" {
+				sp.SetTag("tls.alpn", state.NegotiatedProtocol)
+			}
+		}
+		sp.Finish()
+	}
+	if err != nil {
+		h.sp.LogFields(
+			log.String("message", "TLSHandshakeDone"),
+			log.String("event", "error"),
+			log.Error(err),
+		)
+	} else {
+		h.sp.LogFields(log.String("event", "TLSHandshakeDone"))
+	}
+}
+
+// errorType classifies a RoundTrip error for the error.type tag.
+func errorType(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), os.IsTimeout(err),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connrefused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connreset"
+	case errors.As(err, &recordErr), errors.As(err, &unknownAuthorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return "tls"
+	}
+	return "other"
+}
+
+// connectKey returns the key of the sub-span of a connection attempt.
+// Attempts to several addresses of a host may run in parallel.
+func connectKey(network, addr string) string {
+	return phaseConnect + " " + network + " " + addr
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
@@ -0,0 +1,135 @@
+//go:build go1.7
+// +build go1.7
+
+package nethttp
+
+import (
+	"net/http"
+	"net/url"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// Config holds the settings shared by the server and the client
+// instrumentation of a service, so that inbound and outbound requests are
+// traced consistently.
+type Config struct {
+	// Tracer is the tracer used for both server and client spans.
+	Tracer opentracing.Tracer
+
+	// URLTagFunc, if set, is used to set the http.url tag, eg to redact
+	// sensitive information.
+	URLTagFunc func(u *url.URL) string
+
+	// ComponentName is the component name of the spans. Defaults to
+	// "net/http".
+	ComponentName string
+
+	// BinaryHeader, if set, names a header that carries the span context
+	// in the opentracing.Binary format, base64 encoded, in addition to
+	// the HTTP headers format.
+	BinaryHeader string
+
+	// MaxURLLength, if positive, truncates the http.url tag to this many
+	// runes.
+	MaxURLLength int
+
+	// StripQuery drops the query string from the http.url tag, unless
+	// URLTagFunc is set.
+	StripQuery bool
+}
+
+// MWOptions returns the server middleware options derived from c.
+func (c Config) MWOptions() []MWOption {
+	var options []MWOption
+	if c.ComponentName != "" {
+		options = append(options, MWComponentName(c.ComponentName))
+	}
+	if c.URLTagFunc != nil {
+		options = append(options, MWURLTagFunc(c.URLTagFunc))
+	}
+	if c.StripQuery {
+		options = append(options, MWStripQuery())
+	}
+	if c.MaxURLLength > 0 {
+		options = append(options, MWMaxURLLength(c.MaxURLLength))
+	}
+	if c.BinaryHeader != "" {
+		options = append(options, MWBinaryExtraction(c.BinaryHeader))
+	}
+	return options
+}
+
+// ClientOptions returns the client options derived from c.
+func (c Config) ClientOptions() []ClientOption {
+	var options []ClientOption
+	if c.ComponentName != "" {
+		options = append(options, ComponentName(c.ComponentName))
+	}
+	if c.URLTagFunc != nil {
+		options = append(options, URLTagFunc(c.URLTagFunc))
+	}
+	if c.StripQuery {
+		options = append(options, StripQuery())
+	}
+	if c.MaxURLLength > 0 {
+		options = append(options, MaxURLLength(c.MaxURLLength))
+	}
+	if c.BinaryHeader != "" {
+		options = append(options, InjectBinary(c.BinaryHeader))
+	}
+	return options
+}
+
+// NewServerMiddleware returns a function that wraps handlers with
+// Middleware configured from cfg. The given options are applied after the
+// ones derived from cfg.
+//
+// Example:
+//
+//	cfg := nethttp.Config{Tracer: tracer, StripQuery: true}
+//	http.ListenAndServe("localhost:80", nethttp.NewServerMiddleware(cfg)(mux))
+func NewServerMiddleware(cfg Config, options ...MWOption) func(http.Handler) http.Handler {
+	options = append(cfg.MWOptions(), options...)
+	return func(h http.Handler) http.Handler {
+		return Middleware(cfg.Tracer, h, options...)
+	}
+}
+
+// NewClientTransport returns a RoundTripper that traces requests sent
+// through rt with options derived from cfg, followed by the given options.
+// A nil rt defaults to http.DefaultTransport.
+//
+// Requests already traced with TraceRequest are handled as by Transport.
+// Other requests are traced as if TraceRequest had been called for each of
+// them, and since there is no caller to call Tracer.Finish, the root span
+// is finished together with the per-request span. Redirects followed by
+// http.Client are therefore traced as separate requests.
+//
+// Example:
+//
+//	cfg := nethttp.Config{Tracer: tracer, StripQuery: true}
+//	client := &http.Client{Transport: nethttp.NewClientTransport(cfg, nil)}
+func NewClientTransport(cfg Config, rt http.RoundTripper, options ...ClientOption) http.RoundTripper {
+	options = append(cfg.ClientOptions(), options...)
+	options = append(options, ClientAutoFinish())
+	return &configuredTransport{
+		transport: &Transport{RoundTripper: rt},
+		tracer:    cfg.Tracer,
+		options:   options,
+	}
+}
+
+type configuredTransport struct {
+	transport *Transport
+	tracer    opentracing.Tracer
+	options   []ClientOption
+}
+
+// RoundTrip implements the RoundTripper interface.
+func (t *configuredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if TracerFromRequest(req) == nil {
+		req, _ = TraceRequest(t.tracer, req, t.options...)
+	}
+	return t.transport.RoundTrip(req)
+}
@@ -0,0 +1,63 @@
+package nethttp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestConfig(t *testing.T) {
+	t.Parallel()
+	tr := mocktracer.New()
+	cfg := Config{Tracer: tr, ComponentName: "my-service", StripQuery: true}
+
+	backend := httptest.NewServer(NewServerMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	t.Cleanup(backend.Close)
+
+	client := &http.Client{Transport: NewClientTransport(cfg, nil)}
+	resp, err := client.Get(backend.URL + "/ok?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	spans := tr.FinishedSpans()
+	if got, want := len(spans), 3; got != want {
+		t.Fatalf("got %d spans, expected %d", got, want)
+	}
+	var serverSpan, clientSpan, rootSpan *mocktracer.MockSpan
+	for _, span := range spans {
+		switch span.OperationName {
+		case "HTTP Client":
+			rootSpan = span
+		case "HTTP GET":
+			if span.Tag(string(ext.SpanKind)) == ext.SpanKindRPCServerEnum {
+				serverSpan = span
+			} else {
+				clientSpan = span
+			}
+		}
+	}
+	if serverSpan == nil || clientSpan == nil || rootSpan == nil {
+		t.Fatal("cannot find server, client and root spans")
+	}
+	if got, want := serverSpan.ParentID, clientSpan.SpanContext.SpanID; got != want {
+		t.Fatalf("got server span parent %d, expected %d", got, want)
+	}
+	for _, span := range []*mocktracer.MockSpan{serverSpan, clientSpan} {
+		if got, want := span.Tag("component"), "my-service"; got != want {
+			t.Fatalf("got component %v, expected %v", got, want)
+		}
+	}
+	if got, want := serverSpan.Tag("http.url"), "/ok"; got != want {
+		t.Fatalf("got server url %v, expected %v", got, want)
+	}
+	if got, want := clientSpan.Tag("http.url"), backend.URL+"/ok"; got != want {
+		t.Fatalf("got client url %v, expected %v", got, want)
+	}
+}
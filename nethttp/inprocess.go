@@ -0,0 +1,125 @@
+//go:build go1.7
+// +build go1.7
+
+package nethttp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// inProcessHeader carries the key under which InProcessTransport
+// registered the span context of a request.
+const inProcessHeader = "X-Nethttp-In-Process-Span"
+
+// inProcessSpans holds the span contexts of the requests in flight
+// through InProcessTransport, by key.
+var inProcessSpans sync.Map
+
+// InProcessTransport returns a RoundTripper that traces requests as
+// NewClientTransport does, for servers running in the same process and
+// wrapped with Middleware and MWExtractInProcess, eg a loopback call or an
+// httptest.Server in an integration test. Besides injecting it into the
+// headers, the transport hands the span context of every request sent to
+// a loopback address to the middleware in memory, so that the server span
+// continues the client span even when the tracer cannot propagate it
+// through HTTP headers, and the test sees a single trace. The span context
+// is handed over as is, so the middleware must use a tracer that accepts
+// the span contexts of tr, normally tr itself. Requests sent to other
+// hosts are traced normally. Requests are sent through rt, or
+// http.DefaultTransport if rt is nil.
+//
+// Example:
+//
+//	srv := httptest.NewServer(nethttp.Middleware(tracer, handler, nethttp.MWExtractInProcess()))
+//	client := &http.Client{Transport: nethttp.InProcessTransport(tracer, srv.Client().Transport)}
+func InProcessTransport(tr opentracing.Tracer, rt http.RoundTripper, options ...ClientOption) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return NewClientTransport(Config{Tracer: tr}, inProcessRoundTripper{rt: rt}, options...)
+}
+
+// inProcessRoundTripper registers the span context of the request being
+// sent for the time of the round trip.
+type inProcessRoundTripper struct {
+	rt http.RoundTripper
+}
+
+func (t inProcessRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Del(inProcessHeader)
+	tracer := TracerFromRequest(req)
+	if tracer == nil || tracer.sp == nil || !isLoopback(req.URL.Host) {
+		return t.rt.RoundTrip(req)
+	}
+	if _, noop := tracer.sp.Tracer().(opentracing.NoopTracer); noop {
+		return t.rt.RoundTrip(req)
+	}
+	key, err := newInProcessKey()
+	if err != nil {
+		return t.rt.RoundTrip(req)
+	}
+	inProcessSpans.Store(key, tracer.sp.Context())
+	defer inProcessSpans.Delete(key)
+	req.Header.Set(inProcessHeader, key)
+	return t.rt.RoundTrip(req)
+}
+
+// newInProcessKey returns a random key, so that a request cannot pick up
+// the span context of another one by guessing its key.
+func newInProcessKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// isLoopback reports whether hostport names the local host.
+func isLoopback(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// takeInProcessKey returns the value of the in-process header of r and a
+// shallow copy of r without that header, so that it is neither seen by the
+// handler nor forwarded. r itself is left untouched.
+func takeInProcessKey(r *http.Request) (string, *http.Request) {
+	key := r.Header.Get(inProcessHeader)
+	if key == "" {
+		return "", r
+	}
+	r = r.WithContext(r.Context())
+	r.Header = r.Header.Clone()
+	r.Header.Del(inProcessHeader)
+	return key, r
+}
+
+// inProcessSpanContext returns the span context registered by
+// InProcessTransport under key. The random key already scopes the
+// handover to the request that carries it.
+func inProcessSpanContext(key string) (opentracing.SpanContext, bool) {
+	if key == "" {
+		return nil, false
+	}
+	v, ok := inProcessSpans.Load(key)
+	if !ok {
+		return nil, false
+	}
+	ctx, ok := v.(opentracing.SpanContext)
+	return ctx, ok
+}
@@ -0,0 +1,172 @@
+package nethttp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestInProcessTransport(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		newServer func(handler http.Handler) *httptest.Server
+		name      string
+		options   []MWOption
+		continued bool
+		header    bool
+	}{
+		{name: "HTTP", newServer: httptest.NewServer, options: []MWOption{MWExtractInProcess()}, continued: true},
+		{name: "TLS", newServer: httptest.NewTLSServer, options: []MWOption{MWExtractInProcess()}, continued: true},
+		{name: "NotEnabled", newServer: httptest.NewServer, continued: false, header: true},
+	}
+
+	for _, tt := range tests {
+		testCase := tt
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			// A zero MockTracer has no propagators, so the span context can
+			// only be handed over in memory.
+			tr := &mocktracer.MockTracer{}
+			var header string
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header.Get(inProcessHeader)
+			})
+			srv := testCase.newServer(Middleware(tr, h, testCase.options...))
+			t.Cleanup(srv.Close)
+
+			client := &http.Client{Transport: InProcessTransport(tr, srv.Client().Transport)}
+			resp, err := client.Get(srv.URL + "/ok")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+
+			if got, want := header != "", testCase.header; got != want {
+				t.Fatalf("got %s header in the handler %t, expected %t", inProcessHeader, got, want)
+			}
+			var serverSpan, clientSpan *mocktracer.MockSpan
+			for _, span := range tr.FinishedSpans() {
+				if span.OperationName != "HTTP GET" {
+					continue
+				}
+				if span.Tag(string(ext.SpanKind)) == ext.SpanKindRPCServerEnum {
+					serverSpan = span
+				} else {
+					clientSpan = span
+				}
+			}
+			if serverSpan == nil || clientSpan == nil {
+				t.Fatal("cannot find server and client spans")
+			}
+			if got, want := serverSpan.ParentID == clientSpan.SpanContext.SpanID, testCase.continued; got != want {
+				t.Fatalf("got server span continuing the client span %t, expected %t", got, want)
+			}
+		})
+	}
+}
+
+// uncomparableTracer is a tracer whose values cannot be compared with ==.
+type uncomparableTracer struct {
+	opentracing.Tracer
+	_ []int
+}
+
+// The handover is scoped by its random key, so it does not depend on the
+// middleware using the very same tracer value as the transport.
+func TestInProcessTransportTracerInstance(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		clientTracer opentracing.Tracer
+		serverTracer opentracing.Tracer
+		name         string
+	}{
+		{
+			name:         "Other",
+			clientTracer: &mocktracer.MockTracer{},
+			serverTracer: &mocktracer.MockTracer{},
+		},
+		{
+			name:         "Uncomparable",
+			clientTracer: uncomparableTracer{Tracer: &mocktracer.MockTracer{}},
+			serverTracer: uncomparableTracer{Tracer: &mocktracer.MockTracer{}},
+		},
+	}
+
+	for _, tt := range tests {
+		testCase := tt
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			var parentID int
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if mock, ok := opentracing.SpanFromContext(r.Context()).(*mocktracer.MockSpan); ok {
+					parentID = mock.ParentID
+				}
+			})
+			srv := httptest.NewServer(Middleware(testCase.serverTracer, h, MWExtractInProcess()))
+			t.Cleanup(srv.Close)
+
+			client := &http.Client{Transport: InProcessTransport(testCase.clientTracer, nil)}
+			resp, err := client.Get(srv.URL + "/ok")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+
+			if parentID == 0 {
+				t.Fatal("got server span without parent, expected the client span")
+			}
+		})
+	}
+}
+
+func TestMWExtractInProcessKeepsRequest(t *testing.T) {
+	t.Parallel()
+	var header string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(inProcessHeader)
+	})
+	mw := Middleware(&mocktracer.MockTracer{}, h, MWExtractInProcess())
+
+	r := httptest.NewRequest(http.MethodGet, "/ok", nil)
+	r.Header.Set(inProcessHeader, "key")
+	mw.ServeHTTP(httptest.NewRecorder(), r)
+
+	if header != "" {
+		t.Fatalf("got %s header %q in the handler, expected none", inProcessHeader, header)
+	}
+	if got, want := r.Header.Get(inProcessHeader), "key"; got != want {
+		t.Fatalf("got %q, expected %q", got, want)
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		host     string
+		loopback bool
+	}{
+		{host: "127.0.0.1:8080", loopback: true},
+		{host: "[::1]:8080", loopback: true},
+		{host: "[::1]", loopback: true},
+		{host: "localhost", loopback: true},
+		{host: "LOCALHOST:80", loopback: true},
+		{host: "example.com:80", loopback: false},
+		{host: "10.0.0.1", loopback: false},
+	}
+
+	for _, tt := range tests {
+		testCase := tt
+		t.Run(testCase.host, func(t *testing.T) {
+			t.Parallel()
+			if got, want := isLoopback(testCase.host), testCase.loopback; got != want {
+				t.Fatalf("got %t, expected %t", got, want)
+			}
+		})
+	}
+}
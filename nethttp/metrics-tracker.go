@@ -6,25 +6,91 @@ package nethttp
 import (
 	"io"
 	"net/http"
+	"sync"
 )
 
+// metricsTracker records the status and size of a response. A buggy
+// handler may keep writing from another goroutine after it returned, so
+// the recorded values are guarded by mu; writes that happen after the
+// span is finished are not reflected in it.
 type metricsTracker struct {
 	http.ResponseWriter
-	status int
-	size   int
+
+	// onPush, if set, is called for every resource pushed, with the
+	// error returned by the underlying Pusher.
+	onPush func(target string, err error)
+
+	mu      sync.Mutex
+	status  int
+	size    int
+	flushes int
+	pushes  int
 }
 
 func (w *metricsTracker) WriteHeader(status int) {
+	w.mu.Lock()
 	w.status = status
+	w.mu.Unlock()
 	w.ResponseWriter.WriteHeader(status)
 }
 
 func (w *metricsTracker) Write(b []byte) (int, error) {
 	size, err := w.ResponseWriter.Write(b)
+	w.mu.Lock()
 	w.size += size
+	w.mu.Unlock()
 	return size, err
 }
 
+// snapshot returns the status and size recorded so far.
+func (w *metricsTracker) snapshot() (status, size int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status, w.size
+}
+
+func (w *metricsTracker) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+	w.mu.Lock()
+	w.flushes++
+	w.mu.Unlock()
+}
+
+// Push is only exposed by wrappedResponseWriter when the underlying
+// ResponseWriter implements http.Pusher.
+func (w *metricsTracker) Push(target string, opts *http.PushOptions) error {
+	pusher, ok := w.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	err := pusher.Push(target, opts)
+	if err == nil {
+		w.mu.Lock()
+		w.pushes++
+		w.mu.Unlock()
+	}
+	if w.onPush != nil {
+		w.onPush(target, err)
+	}
+	return err
+}
+
+// pushCount returns the number of resources successfully pushed.
+func (w *metricsTracker) pushCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pushes
+}
+
+// flushCount returns the number of times the response was flushed.
+func (w *metricsTracker) flushCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushes
+}
+
 // wrappedResponseWriter returns a wrapped version of the original
 // ResponseWriter and only implements the same combination of additional
 // interfaces as the original.  This implementation is based on
@@ -33,9 +99,11 @@ func (w *metricsTracker) wrappedResponseWriter() http.ResponseWriter {
 	var (
 		hj, i0 = w.ResponseWriter.(http.Hijacker)
 		cn, i1 = w.ResponseWriter.(http.CloseNotifier) //nolint:staticcheck // TODO: Replace deprecated CloseNotifier
-		pu, i2 = w.ResponseWriter.(http.Pusher)
-		fl, i3 = w.ResponseWriter.(http.Flusher)
+		_, i2  = w.ResponseWriter.(http.Pusher)
+		_, i3  = w.ResponseWriter.(http.Flusher)
 		rf, i4 = w.ResponseWriter.(io.ReaderFrom)
+		fl     = http.Flusher(w)
+		pu     = http.Pusher(w)
 	)
 
 	switch {
@@ -0,0 +1,12 @@
+//go:build go1.7 && !go1.22
+// +build go1.7,!go1.22
+
+package nethttp
+
+import "net/http"
+
+// requestPattern returns the http.ServeMux pattern that matched r, which
+// is not available before Go 1.22.
+func requestPattern(r *http.Request) string {
+	return ""
+}
@@ -0,0 +1,12 @@
+//go:build go1.22
+// +build go1.22
+
+package nethttp
+
+import "net/http"
+
+// requestPattern returns the http.ServeMux pattern that matched r, once
+// the mux has served it.
+func requestPattern(r *http.Request) string {
+	return r.Pattern
+}
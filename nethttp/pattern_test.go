@@ -0,0 +1,60 @@
+//go:build go1.22
+// +build go1.22
+
+//go:debug httpmuxgo121=0
+
+package nethttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestRoutePatternOption(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /items/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET api.example.com/users", func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		host   interface{}
+		name   string
+		method string
+		url    string
+		opName string
+		route  string
+	}{
+		{name: "Method", method: http.MethodPost, url: "/items/42", opName: "POST /items/{id}", route: "/items/{id}", host: nil},
+		{name: "NoMethod", method: http.MethodGet, url: "/static/app.js", opName: "GET /static/", route: "/static/", host: nil},
+		{name: "NoMethodDelete", method: http.MethodDelete, url: "/static/app.js", opName: "DELETE /static/", route: "/static/", host: nil},
+		{name: "Host", method: http.MethodGet, url: "http://api.example.com/users", opName: "GET /users", route: "/users", host: "api.example.com"},
+	}
+
+	for _, tt := range tests {
+		testCase := tt
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			tr := &mocktracer.MockTracer{}
+			mw := Middleware(tr, mux, MWRoutePattern())
+			mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(testCase.method, testCase.url, nil))
+
+			spans := tr.FinishedSpans()
+			if got, want := len(spans), 1; got != want {
+				t.Fatalf("got %d spans, expected %d", got, want)
+			}
+			if got, want := spans[0].OperationName, testCase.opName; got != want {
+				t.Fatalf("got operation name %s, expected %s", got, want)
+			}
+			if got, want := spans[0].Tag("http.route"), testCase.route; got != want {
+				t.Fatalf("got route %v, expected %v", got, want)
+			}
+			if got, want := spans[0].Tag("http.route_host"), testCase.host; got != want {
+				t.Fatalf("got route host %v, expected %v", got, want)
+			}
+		})
+	}
+}
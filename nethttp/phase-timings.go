@@ -0,0 +1,73 @@
+//go:build go1.7
+// +build go1.7
+
+package nethttp
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	phaseDNS             = "dns"
+	phaseConnect         = "connect"
+	phaseTLS             = "tls"
+	phaseWait100Continue = "wait_100_continue"
+	phaseWriteRequest    = "write_request"
+	phaseGetConn         = "get_conn"
+)
+
+// setupPhases are the phases of establishing a new connection.
+var setupPhases = []string{phaseDNS, phaseConnect, phaseTLS}
+
+// requestPhases are the other phases of sending a request. Getting a
+// connection includes setting up a new one, if no idle connection was
+// available.
+var requestPhases = []string{phaseGetConn, phaseWait100Continue, phaseWriteRequest}
+
+// phaseTimings records the duration of the phases of a client request,
+// as reported by the httptrace hooks. The hooks may be called from other
+// goroutines than the one running the request.
+type phaseTimings struct {
+	started map[string]time.Time
+	elapsed map[string]time.Duration
+	mu      sync.Mutex
+}
+
+func (p *phaseTimings) reset() {
+	p.mu.Lock()
+	p.started = nil
+	p.elapsed = nil
+	p.mu.Unlock()
+}
+
+func (p *phaseTimings) start(phase string) {
+	p.mu.Lock()
+	if p.started == nil {
+		p.started = make(map[string]time.Time)
+	}
+	p.started[phase] = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *phaseTimings) done(phase string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start, ok := p.started[phase]
+	if !ok {
+		return
+	}
+	delete(p.started, phase)
+	if p.elapsed == nil {
+		p.elapsed = make(map[string]time.Duration)
+	}
+	p.elapsed[phase] += time.Since(start)
+}
+
+// get returns the duration of phase, and whether it completed.
+func (p *phaseTimings) get(phase string) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.elapsed[phase]
+	return d, ok
+}
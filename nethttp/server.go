@@ -4,21 +4,109 @@
 package nethttp
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
 )
 
 var responseSizeKey = "http.response_size"
 
+// defaultProbeAgents are the User-Agent prefixes of common health checkers.
+var defaultProbeAgents = []string{
+	"kube-probe/",
+	"ELB-HealthChecker/",
+	"GoogleHC/",
+	"Consul Health Check",
+	"Prometheus/",
+}
+
 type mwOptions struct {
 	opNameFunc    func(r *http.Request) string
 	spanFilter    func(r *http.Request) bool
 	spanObserver  func(span opentracing.Span, r *http.Request)
 	urlTagFunc    func(u *url.URL) string
+	finishOptions func(r *http.Request, status int) opentracing.FinishOptions
+	finishOpName  func(r *http.Request, status int) string
+	genRequestID  func() string
+	handlerName   func(r *http.Request) string
+	userAgentFunc func(userAgent string) string
+	validTenant   func(tenant string) bool
+	sampledFunc   func(sp opentracing.Span) (sampled, known bool)
+	routeFunc     func(r *http.Request) string
+	parseDeadline func(string) (time.Duration, error)
+	traceIDFunc   func(sc opentracing.SpanContext) uint64
 	componentName string
+	deadlineName  string
+	attemptHeader string
+	binaryHeader  string
+	fingerprint   string
+	cacheHeader   string
+	requestIDName string
+	overrideName  string
+	tenantHeader  string
+	baggagePrefix string
+	priorityPaths []string
+	latencyBounds []time.Duration
+	probeAgents   []string
+	sampleRate    float64
+	maxURLLength  int
+	hashLimit     int64
+	logRedirect   bool
+	stripQuery    bool
+	http2StreamID bool
+	deadlineCtx   bool
+	afterFlush    bool
+	inflight      bool
+	tagHandler    bool
+	sniTag        bool
+	clientCert    bool
+	userAgentTag  bool
+	varyTag       bool
+	overrideOp    bool
+	requestSize   bool
+	routePattern  bool
+	acceptDelay   bool
+	streamingTag  bool
+	trackPushes   bool
+	headerBytes   bool
+	upgradeTag    bool
+	uncompressed  bool
+	cookieNames   bool
+	setCookies    bool
+	b3Single      bool
+	inProcess     bool
+	handlerError  bool
+	authScheme    bool
+	conditional   bool
+	queryCount    bool
+	outcomeTag    bool
+	urlLengths    bool
+	statusText    bool
+	sample        bool
+	panicSpan     bool
 }
 
 // MWOption controls the behavior of the Middleware.
@@ -32,6 +120,67 @@ func OperationNameFunc(f func(r *http.Request) string) MWOption {
 	}
 }
 
+// HostOperationName returns a function, to be used with OperationNameFunc,
+// that names server-side spans after the virtual host of the request.
+// format may contain the placeholders {host} and {method}, e.g.
+// "{host} {method}". The port is stripped from the host. If mapHost is not
+// nil, it is applied to the host, e.g. to collapse subdomains and keep the
+// number of distinct operation names bounded.
+func HostOperationName(format string, mapHost func(host string) string) func(r *http.Request) string {
+	parts := splitPlaceholders(format, "{host}", "{method}")
+	return func(r *http.Request) string {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if mapHost != nil {
+			host = mapHost(host)
+		}
+		var b strings.Builder
+		for _, part := range parts {
+			switch part {
+			case "{host}":
+				b.WriteString(host)
+			case "{method}":
+				b.WriteString(r.Method)
+			default:
+				b.WriteString(part)
+			}
+		}
+		return b.String()
+	}
+}
+
+// splitPlaceholders splits format into literal text and placeholders,
+// scanning left to right as strings.Replacer does.
+func splitPlaceholders(format string, placeholders ...string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(format); {
+		var placeholder string
+		for _, p := range placeholders {
+			if strings.HasPrefix(format[i:], p) {
+				placeholder = p
+				break
+			}
+		}
+		if placeholder == "" {
+			i++
+			continue
+		}
+		if start < i {
+			parts = append(parts, format[start:i])
+		}
+		parts = append(parts, placeholder)
+		i += len(placeholder)
+		start = i
+	}
+	if start < len(format) {
+		parts = append(parts, format[start:])
+	}
+	return parts
+}
+
 // MWComponentName returns a MWOption that sets the component name
 // for the server-side span.
 func MWComponentName(componentName string) MWOption {
@@ -49,6 +198,39 @@ func MWSpanFilter(f func(r *http.Request) bool) MWOption {
 	}
 }
 
+// MWConsistentSample returns a MWOption that creates a span for the
+// given fraction rate of the requests only, deciding from the trace ID of
+// the parent span context, as returned by traceIDExtractor, so that all
+// the services of a trace using the same rate keep or drop it
+// consistently. opentracing does not expose trace IDs, hence the
+// extractor. The trace ID is hashed with the SplitMix64 finalizer, and the
+// trace is kept if the hash falls in the lowest rate fraction of the
+// uint64 range. Requests without a parent span context, for which the
+// extractor must return 0, or with a nil traceIDExtractor, are sampled at
+// random. Requests that are not sampled are handled as with MWSpanFilter.
+func MWConsistentSample(rate float64, traceIDExtractor func(opentracing.SpanContext) uint64) MWOption {
+	return func(options *mwOptions) {
+		options.sample = true
+		options.sampleRate = rate
+		options.traceIDFunc = traceIDExtractor
+	}
+}
+
+// MWDropProbes returns a MWOption that prevents requests from health
+// checkers from creating a span. A request is a probe if its User-Agent
+// starts with one of agents, which default to the agents of Kubernetes,
+// AWS ELB, Google Cloud load balancers, Consul and Prometheus. It composes
+// with MWSpanFilter: a span is created only if both let the request
+// through.
+func MWDropProbes(agents ...string) MWOption {
+	return func(options *mwOptions) {
+		if len(agents) == 0 {
+			agents = defaultProbeAgents
+		}
+		options.probeAgents = agents
+	}
+}
+
 // MWSpanObserver returns a MWOption that observe the span
 // for the server-side span.
 func MWSpanObserver(f func(span opentracing.Span, r *http.Request)) MWOption {
@@ -66,12 +248,690 @@ func MWURLTagFunc(f func(u *url.URL) string) MWOption {
 	}
 }
 
+// MWFinishOptionsFunc returns a MWOption that uses given function f
+// to generate the FinishOptions of the server-side span from the request
+// and the response status code. Can be used to set an explicit finish
+// time or to attach bulk log records computed from the outcome.
+func MWFinishOptionsFunc(f func(r *http.Request, status int) opentracing.FinishOptions) MWOption {
+	return func(options *mwOptions) {
+		options.finishOptions = f
+	}
+}
+
+// MWStripQuery returns a MWOption that drops the query string from the
+// span's http.url tag. A function set with MWURLTagFunc takes precedence,
+// regardless of the order of the options.
+func MWStripQuery() MWOption {
+	return func(options *mwOptions) {
+		options.stripQuery = true
+	}
+}
+
+// MWHTTP2StreamIDTag returns a MWOption that sets the http2.stream_id tag
+// on the server-side span of HTTP/2 requests.
+//
+// net/http does not expose the stream ID of a request, so the ID is only
+// known when it was stored in the request context with WithHTTP2StreamID,
+// e.g. by a custom HTTP/2 server or a handler wrapping the middleware.
+// When no stream ID is available the option is a no-op.
+func MWHTTP2StreamIDTag() MWOption {
+	return func(options *mwOptions) {
+		options.http2StreamID = true
+	}
+}
+
+// WithHTTP2StreamID returns a copy of ctx that carries the HTTP/2 stream
+// ID of the request, to be recorded by MWHTTP2StreamIDTag.
+func WithHTTP2StreamID(ctx context.Context, id uint32) context.Context {
+	return context.WithValue(ctx, keyHTTP2StreamID, id)
+}
+
+// MWDeadlineHeader returns a MWOption that reads the time budget of the
+// request from the header name, parsed by parse, or by time.ParseDuration
+// if parse is nil, and records it as the http.server.deadline_ms tag.
+// Missing or invalid headers are ignored.
+func MWDeadlineHeader(name string, parse func(string) (time.Duration, error)) MWOption {
+	if parse == nil {
+		parse = time.ParseDuration
+	}
+	return func(options *mwOptions) {
+		options.deadlineName = name
+		options.parseDeadline = parse
+	}
+}
+
+// MWDeadlineContext returns a MWOption that applies the time budget read
+// by MWDeadlineHeader as a deadline on the request context passed to the
+// handler.
+func MWDeadlineContext() MWOption {
+	return func(options *mwOptions) {
+		options.deadlineCtx = true
+	}
+}
+
+// MWAttemptCountHeader returns a MWOption that records the attempt
+// number set by a retrying proxy in the header name, e.g.
+// x-envoy-attempt-count, as the http.request.attempt tag. Missing or
+// invalid headers are ignored.
+func MWAttemptCountHeader(name string) MWOption {
+	return func(options *mwOptions) {
+		options.attemptHeader = name
+	}
+}
+
+// MWFinishAfterFlush returns a MWOption that, for handlers that flushed
+// the response at least once, flushes the response again once the handler
+// returned and finishes the server-side span after that final flush, so
+// that the span covers the time spent pushing the end of the response to
+// the client rather than ending when the handler returns. Responses that
+// cannot be flushed, and spans of handlers that never flush or that
+// panic, are finished when the handler returns.
+func MWFinishAfterFlush() MWOption {
+	return func(options *mwOptions) {
+		options.afterFlush = true
+	}
+}
+
+// WithAcceptTime returns a copy of ctx that carries the time the
+// connection of the request was accepted. When the request context carries
+// an accept time, the middleware records the time elapsed between accept
+// and the start of the server-side span as the http.server.queue_time_ms
+// tag. The time is typically stamped by http.Server's ConnContext hook:
+//
+//	srv := &http.Server{
+//		Handler: nethttp.Middleware(tracer, mux),
+//		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+//			return nethttp.WithAcceptTime(ctx, time.Now())
+//		},
+//	}
+//
+// ConnContext runs once per connection, so for requests on a kept-alive
+// connection the queue time includes the time spent serving earlier
+// requests on that connection.
+func WithAcceptTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, keyAcceptTime, t)
+}
+
+// WithServerAddr returns a copy of ctx that carries addr, the "host:port"
+// address of the listener that accepted the request. When the request
+// context carries a server address, the middleware records it as the
+// net.host.name and net.host.port tags, which tell apart the listeners of
+// a server with several of them. The address is typically stamped by
+// http.Server's BaseContext hook:
+//
+//	srv := &http.Server{
+//		Handler: nethttp.Middleware(tracer, mux),
+//		BaseContext: func(l net.Listener) context.Context {
+//			return nethttp.WithServerAddr(context.Background(), l.Addr().String())
+//		},
+//	}
+func WithServerAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, keyServerAddr, addr)
+}
+
+// MWAcceptDelay returns a MWOption that also records the delay between
+// the accept time set with WithAcceptTime and the start of the
+// server-side span as the http.server.accept_delay_ms tag, for dashboards
+// that track scheduling delay under that name. Requests without an accept
+// time get no tag.
+func MWAcceptDelay() MWOption {
+	return func(options *mwOptions) {
+		options.acceptDelay = true
+	}
+}
+
+// MWCacheStatusHeader returns a MWOption that reads the cache status set
+// by a cache in the response header name, e.g. X-Cache, and records it as
+// the http.cache_status tag along with a boolean http.cache_hit tag.
+// Values that don't start with HIT or MISS are ignored.
+func MWCacheStatusHeader(name string) MWOption {
+	return func(options *mwOptions) {
+		options.cacheHeader = name
+	}
+}
+
+// MWFinishOperationNameFunc returns a MWOption that uses given function f
+// to rename the server-side span once the response status code is known,
+// eg "GET /users 200", or to a specific name on 5xx responses. The name
+// is left unchanged when f returns an empty string. f takes precedence
+// over the route options. Note that including the status code, or any
+// other request specific value, multiplies the number of distinct
+// operation names, which many tracing backends handle poorly.
+func MWFinishOperationNameFunc(f func(r *http.Request, status int) string) MWOption {
+	return func(options *mwOptions) {
+		options.finishOpName = f
+	}
+}
+
+// MWGenerateRequestID returns a MWOption that reads the request ID from
+// the header headerName and, when it is missing, generates one with gen and
+// sets it on the response header. The request ID is recorded as the
+// http.request_id tag and stored in the request context, from where it can
+// be retrieved with RequestIDFromContext. A nil gen generates random IDs
+// of 32 hexadecimal digits.
+func MWGenerateRequestID(headerName string, gen func() string) MWOption {
+	if gen == nil {
+		gen = newRequestID
+	}
+	return func(options *mwOptions) {
+		options.requestIDName = headerName
+		options.genRequestID = gen
+	}
+}
+
+// RequestIDFromContext returns the request ID stored in ctx by the
+// middleware, or an empty string if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(keyRequestID).(string)
+	return id
+}
+
+// FollowsFromContext returns a StartSpanOption that makes a span follow
+// from the span in ctx, typically the server-side span of a request, for
+// work that outlives the request such as background jobs started by the
+// handler:
+//
+//	go func() {
+//		sp := tracer.StartSpan("send-email", nethttp.FollowsFromContext(r.Context()))
+//		defer sp.Finish()
+//		...
+//	}()
+//
+// The option does nothing if ctx carries no span.
+func FollowsFromContext(ctx context.Context) opentracing.StartSpanOption {
+	if sp := opentracing.SpanFromContext(ctx); sp != nil {
+		return opentracing.FollowsFrom(sp.Context())
+	}
+	return noopStartSpanOption{}
+}
+
+type noopStartSpanOption struct{}
+
+func (noopStartSpanOption) Apply(*opentracing.StartSpanOptions) {}
+
+// UncompressedSizer is implemented by the ResponseWriters of compression
+// middleware to report the size of the response before compression.
+type UncompressedSizer interface {
+	UncompressedSize() int
+}
+
+// uncompressedSizerHolder carries the UncompressedSizer registered for a
+// request. It is shared through the request context, so the middleware
+// sees a sizer registered by handlers it wraps.
+type uncompressedSizerHolder struct {
+	sizer UncompressedSizer
+	mu    sync.Mutex
+}
+
+// MWUncompressedSizeTag returns a MWOption that records the size of the
+// response before compression as the http.response_uncompressed_size tag,
+// next to http.response_size, which counts the compressed bytes written by
+// a compression middleware wrapped by Middleware. The compression
+// middleware reports its writer with SetUncompressedSizer:
+//
+//	func gzipHandler(h http.Handler) http.Handler {
+//		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//			gw := newGzipResponseWriter(w) // implements UncompressedSizer
+//			defer gw.Close()
+//			nethttp.SetUncompressedSizer(r.Context(), gw)
+//			h.ServeHTTP(gw, r)
+//		})
+//	}
+//
+//	http.ListenAndServe("localhost:80", nethttp.Middleware(tracer, gzipHandler(mux), nethttp.MWUncompressedSizeTag()))
+func MWUncompressedSizeTag() MWOption {
+	return func(options *mwOptions) {
+		options.uncompressed = true
+	}
+}
+
+// SetUncompressedSizer registers s as the source of the uncompressed size
+// of the response to the request with context ctx. It does nothing unless
+// the request is traced by a Middleware with MWUncompressedSizeTag.
+func SetUncompressedSizer(ctx context.Context, s UncompressedSizer) {
+	if holder, ok := ctx.Value(keyUncompressedSizer).(*uncompressedSizerHolder); ok {
+		holder.mu.Lock()
+		holder.sizer = s
+		holder.mu.Unlock()
+	}
+}
+
+// size returns the uncompressed size reported by the registered sizer, and
+// whether there is one.
+func (h *uncompressedSizerHolder) size() (int, bool) {
+	h.mu.Lock()
+	sizer := h.sizer
+	h.mu.Unlock()
+	if sizer == nil {
+		return 0, false
+	}
+	return sizer.UncompressedSize(), true
+}
+
+// MWPrioritySamplePaths returns a MWOption that asks the tracer to
+// always sample the server-side spans of requests whose path starts with
+// one of prefixes, by setting the sampling.priority tag to 1 when the span
+// is started.
+func MWPrioritySamplePaths(prefixes ...string) MWOption {
+	return func(options *mwOptions) {
+		options.priorityPaths = append(options.priorityPaths, prefixes...)
+	}
+}
+
+// MWInflightGauge returns a MWOption that counts the requests being
+// served by the middleware and records the count at the start of each
+// request, including the request itself, as the
+// http.server.inflight_at_start tag. Requests excluded by MWSpanFilter are
+// counted too.
+func MWInflightGauge() MWOption {
+	return func(options *mwOptions) {
+		options.inflight = true
+	}
+}
+
+// MWMaxURLLength returns a MWOption that truncates the span's http.url
+// tag to n runes, appending "..." and setting the http.url_truncated tag
+// when it was truncated. Truncation is applied to the value returned by
+// the http.url tag function, see MWURLTagFunc.
+func MWMaxURLLength(n int) MWOption {
+	return func(options *mwOptions) {
+		options.maxURLLength = n
+	}
+}
+
+// MWBinaryExtraction returns a MWOption that, when the parent span
+// context can't be extracted from the HTTP headers, extracts it in the
+// opentracing.Binary format from the base64 encoded header headerName.
+func MWBinaryExtraction(headerName string) MWOption {
+	return func(options *mwOptions) {
+		options.binaryHeader = headerName
+	}
+}
+
+// MWTagHandlerName returns a MWOption that records the name of the
+// wrapped handler function as the http.handler tag. The name is resolved
+// once, when the middleware is created. Note that when the middleware wraps
+// an http.Handler, such as an http.ServeMux, the name is the one of its
+// ServeHTTP method rather than of the handler that serves the request;
+// use MWHandlerNameFunc to provide the name per request.
+func MWTagHandlerName() MWOption {
+	return func(options *mwOptions) {
+		options.tagHandler = true
+	}
+}
+
+// MWHandlerNameFunc returns a MWOption that uses given function f to
+// set the http.handler tag per request. A non-empty name returned by f
+// takes precedence over the one recorded by MWTagHandlerName.
+func MWHandlerNameFunc(f func(r *http.Request) string) MWOption {
+	return func(options *mwOptions) {
+		options.handlerName = f
+	}
+}
+
+// MWSNITag returns a MWOption that records the server name requested by
+// the client through TLS SNI as the tls.sni tag. Plaintext requests and
+// requests without SNI get no tag.
+func MWSNITag() MWOption {
+	return func(options *mwOptions) {
+		options.sniTag = true
+	}
+}
+
+// MWTLSClientCertTags returns a MWOption that records the subject,
+// issuer and serial number of the verified TLS client certificate as the
+// tls.client.subject, tls.client.issuer and tls.client.serial tags.
+// Requests without a verified client certificate get no tags. Certificate
+// subjects may contain personal data, so this is not enabled by default.
+func MWTLSClientCertTags() MWOption {
+	return func(options *mwOptions) {
+		options.clientCert = true
+	}
+}
+
+// MWRequestSize returns a MWOption that records the number of request
+// body bytes read by the handler as the http.request_size tag. If the
+// request has a Content-Length and the handler read a different number of
+// bytes, eg because the upload was truncated, http.request.size_mismatch
+// is set to true. The time the handler spent blocked reading the body is
+// recorded as the http.server.body_read_ms tag and, if the handler read
+// the body to the end, the time spent after that, computing the response,
+// as the http.server.process_time_ms tag. The Content-Encoding of
+// compressed request bodies is recorded as the
+// http.request.content_encoding tag; note that the size is then the one
+// of the body as read by the handler, which is still compressed unless a
+// handler wrapped by the middleware decompresses it.
+func MWRequestSize() MWOption {
+	return func(options *mwOptions) {
+		options.requestSize = true
+	}
+}
+
+// MWBodyFingerprint returns a MWOption that hashes the request body as
+// the handler reads it and records a short hex digest of it as the tag
+// tagName. Only the first 64 KiB of the body are hashed, unless changed
+// with MWBodyFingerprintLimit. The body is never read by the middleware
+// itself, so the digest only covers the part the handler read.
+func MWBodyFingerprint(tagName string) MWOption {
+	return func(options *mwOptions) {
+		options.fingerprint = tagName
+	}
+}
+
+// MWBodyFingerprintLimit returns a MWOption that sets the maximum number
+// of request body bytes hashed by MWBodyFingerprint.
+func MWBodyFingerprintLimit(n int64) MWOption {
+	return func(options *mwOptions) {
+		options.hashLimit = n
+	}
+}
+
+// MWUserAgentTag returns a MWOption that records the User-Agent header of
+// the request as the http.user_agent tag. Requests without a User-Agent
+// header get no tag.
+func MWUserAgentTag() MWOption {
+	return func(options *mwOptions) {
+		options.userAgentTag = true
+	}
+}
+
+// MWUserAgentNormalizer returns a MWOption that passes the user agent
+// through f before it is recorded by MWUserAgentTag, eg to bucket the
+// high-cardinality raw values into a few families such as "chrome", "bot"
+// or "kube-probe". No tag is set if f returns an empty string.
+func MWUserAgentNormalizer(f func(userAgent string) string) MWOption {
+	return func(options *mwOptions) {
+		options.userAgentFunc = f
+	}
+}
+
+// MWTenantHeader returns a MWOption that records the tenant sent in the
+// request header name as the http.tenant tag. If validate is not nil and
+// reports the tenant as invalid, http.tenant_invalid is set to true; the
+// request is served regardless, rejecting it is up to the handler.
+func MWTenantHeader(name string, validate func(tenant string) bool) MWOption {
+	return func(options *mwOptions) {
+		options.tenantHeader = name
+		options.validTenant = validate
+	}
+}
+
+// MWRequestHeaderBytesTag returns a MWOption that records the size of the
+// request headers as the http.request_header_bytes tag, to help catch the
+// header bloat that leads to 431 responses. The size is an estimate: the
+// sum of the lengths of the names and values, without separators and
+// without the Host header, which net/http removes from r.Header.
+func MWRequestHeaderBytesTag() MWOption {
+	return func(options *mwOptions) {
+		options.headerBytes = true
+	}
+}
+
+// MWUpgradeTag returns a MWOption that records the protocol a request
+// asks to upgrade to, eg "websocket" or "h2c", as the http.upgrade tag.
+// Requests without a Connection: upgrade header get no tag.
+func MWUpgradeTag() MWOption {
+	return func(options *mwOptions) {
+		options.upgradeTag = true
+	}
+}
+
+// MWAuthSchemeTag returns a MWOption that records the scheme of the
+// Authorization header of the request, eg "Bearer" or "Basic", as the
+// http.auth_scheme tag. The credentials are never recorded: a header
+// without credentials after the scheme, which may be a bare token, gets no
+// tag, and neither do requests without an Authorization header.
+func MWAuthSchemeTag() MWOption {
+	return func(options *mwOptions) {
+		options.authScheme = true
+	}
+}
+
+// MWQueryParamCountTag returns a MWOption that records the number of
+// distinct query parameters of the request as the http.query_param_count
+// tag, eg to spot abusive clients, without recording their values.
+func MWQueryParamCountTag() MWOption {
+	return func(options *mwOptions) {
+		options.queryCount = true
+	}
+}
+
+// MWDumpBaggageTag returns a MWOption that records every baggage item
+// that arrived with the request as a tag named prefix followed by the key
+// of the item, to help troubleshooting propagation. Baggage often carries
+// user identifiers or other personal data, which end up in the tracing
+// backend, so this is meant as a temporary debugging switch rather than
+// to be enabled permanently. An empty prefix disables the option.
+func MWDumpBaggageTag(prefix string) MWOption {
+	return func(options *mwOptions) {
+		options.baggagePrefix = prefix
+	}
+}
+
+// MWURLLengthTags returns a MWOption that records the length in bytes of
+// the request path and of the raw query string as the http.path_length
+// and http.query_length tags, eg to flag oversized requests without
+// recording their content.
+func MWURLLengthTags() MWOption {
+	return func(options *mwOptions) {
+		options.urlLengths = true
+	}
+}
+
+// MWCookieNamesTag returns a MWOption that records the names of the
+// cookies sent with the request, sorted and comma separated, as the
+// http.request.cookie_names tag. Cookie values are never recorded.
+// Requests without cookies get no tag.
+func MWCookieNamesTag() MWOption {
+	return func(options *mwOptions) {
+		options.cookieNames = true
+	}
+}
+
+// MWSetCookieNamesTag returns a MWOption that records the names of the
+// cookies set by the response, sorted and comma separated, as the
+// http.response.set_cookie_names tag. Cookie values and attributes are
+// never recorded. Responses that set no cookie get no tag.
+func MWSetCookieNamesTag() MWOption {
+	return func(options *mwOptions) {
+		options.setCookies = true
+	}
+}
+
+// MWConditionalResponseTag returns a MWOption that records the outcome of
+// conditional requests, ie requests with an If-None-Match,
+// If-Modified-Since, If-Match or If-Unmodified-Since header, as the
+// http.conditional tag: "hit" for a 304 Not Modified response and "miss"
+// for a 412 Precondition Failed response. Other responses get no tag.
+func MWConditionalResponseTag() MWOption {
+	return func(options *mwOptions) {
+		options.conditional = true
+	}
+}
+
+// MWVaryTag returns a MWOption that records the Vary header of the
+// response as the http.response.vary tag, to help debugging cache keys.
+// Multiple Vary headers are joined with commas. Responses without a Vary
+// header get no tag.
+func MWVaryTag() MWOption {
+	return func(options *mwOptions) {
+		options.varyTag = true
+	}
+}
+
+// MWMethodOverrideHeader returns a MWOption that records the method
+// tunneled through the header name, eg X-HTTP-Method-Override, as the
+// http.method_effective tag, next to the http.method tag holding the
+// method of the request itself.
+func MWMethodOverrideHeader(name string) MWOption {
+	return func(options *mwOptions) {
+		options.overrideName = name
+	}
+}
+
+// MWMethodOverrideOperationName returns a MWOption that makes the
+// operation name function see the method from the MWMethodOverrideHeader
+// header instead of the method of the request, when the header is set.
+func MWMethodOverrideOperationName() MWOption {
+	return func(options *mwOptions) {
+		options.overrideOp = true
+	}
+}
+
+// MWRoutePattern returns a MWOption that, when the handler is an
+// http.ServeMux, records the pattern that matched the request. The path of
+// the pattern is set as the http.route tag, its host, if any, as the
+// http.route_host tag, and the pattern without the host becomes the
+// operation name, eg "POST /items/{id}". A pattern without a method is
+// prefixed with the method of the request, eg "GET /static/". Requires
+// Go 1.22; older versions leave the span unchanged.
+func MWRoutePattern() MWOption {
+	return func(options *mwOptions) {
+		options.routePattern = true
+	}
+}
+
+// MWStreamingTag returns a MWOption that sets the http.streaming tag to
+// true when the handler flushed the response at least once, as streaming
+// handlers such as Server-Sent Events endpoints do, and records the number
+// of flushes as the http.flushes tag. Flushes are only observed when the
+// ResponseWriter implements http.Flusher.
+func MWStreamingTag() MWOption {
+	return func(options *mwOptions) {
+		options.streamingTag = true
+	}
+}
+
+// MWTrackPushes returns a MWOption that logs a "push" event with the
+// target of every HTTP/2 server push made by the handler through
+// http.Pusher, and records the number of successful pushes as the
+// http2.pushes tag. It has no effect when the ResponseWriter does not
+// implement http.Pusher.
+func MWTrackPushes() MWOption {
+	return func(options *mwOptions) {
+		options.trackPushes = true
+	}
+}
+
+// MWSampledTag returns a MWOption that records whether the server-side
+// span is sampled as the sampling.sampled tag, right before it is
+// finished. OpenTracing does not expose the sampling decision, so it is
+// read with f, which reports the decision and whether it is known for the
+// tracer in use. No tag is set when it is not known.
+func MWSampledTag(f func(sp opentracing.Span) (sampled, known bool)) MWOption {
+	return func(options *mwOptions) {
+		options.sampledFunc = f
+	}
+}
+
+// MWRoutePatternFunc returns a MWOption that reads the route pattern that
+// matched the request with f once the handler has returned, when routers
+// have done their matching. A non-empty pattern is set as the http.route
+// tag, and, prefixed with the method, as the operation name, eg
+// "GET /users/{id}".
+//
+// This works with any router that exposes the pattern through the
+// request. For example, with go-chi, installing Middleware with the
+// router's Use method gives it a request carrying chi's route context:
+//
+//	router.Use(func(h http.Handler) http.Handler {
+//		return nethttp.Middleware(tracer, h, nethttp.MWRoutePatternFunc(func(r *http.Request) string {
+//			return chi.RouteContext(r.Context()).RoutePattern()
+//		}))
+//	})
+func MWRoutePatternFunc(f func(r *http.Request) string) MWOption {
+	return func(options *mwOptions) {
+		options.routeFunc = f
+	}
+}
+
+// MWLatencyBucketTag returns a MWOption that records the time spent in
+// the handler as a coarse bucket, the http.latency_bucket tag, for trace
+// search UIs that can group spans by tag but not aggregate numbers. The
+// buckets are delimited by bounds, eg 10ms, 100ms and 1s give the buckets
+// "<10ms", "10ms-100ms", "100ms-1s" and ">=1s".
+func MWLatencyBucketTag(bounds []time.Duration) MWOption {
+	bounds = append([]time.Duration(nil), bounds...)
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	return func(options *mwOptions) {
+		options.latencyBounds = bounds
+	}
+}
+
+// MWStatusTextTag returns a MWOption that records the text of the
+// response status code, eg "Not Found", as the http.status_text tag, for
+// trace UIs that only show the numeric code. Status codes unknown to
+// http.StatusText get no tag.
+func MWStatusTextTag() MWOption {
+	return func(options *mwOptions) {
+		options.statusText = true
+	}
+}
+
+// MWOutcomeTag returns a MWOption that records the outcome of the request
+// as the http.outcome tag, for SLO computation: "success" for status codes
+// below 400, "client_error" for 4xx and "server_error" for 5xx, when the
+// handler panicked or when a handler wrapped by MiddlewareForErrHandler
+// returned an error, consistently with the error tag.
+func MWOutcomeTag() MWOption {
+	return func(options *mwOptions) {
+		options.outcomeTag = true
+	}
+}
+
+// MWPanicSpan returns a MWOption that, when the handler panics, records
+// the panic as a short "panic" child span of the server-side span, with
+// the recovered value and the stack of the handler logged on it, so that
+// panics can be searched for on their own. The server-side span is tagged
+// as usual and the panic is propagated.
+func MWPanicSpan() MWOption {
+	return func(options *mwOptions) {
+		options.panicSpan = true
+	}
+}
+
+// MWExtractB3Single returns a MWOption that, when the parent span context
+// can't be extracted from the HTTP headers, extracts it from the single
+// header B3 format, as sent by Envoy or Istio, by handing the tracer the
+// equivalent X-B3-* headers. The header is ignored if it is absent or
+// malformed.
+func MWExtractB3Single() MWOption {
+	return func(options *mwOptions) {
+		options.b3Single = true
+	}
+}
+
+// MWExtractInProcess returns a MWOption that continues the span context
+// handed over in memory by InProcessTransport, for requests sent by the
+// same process. The header carrying the handover key is removed from the
+// request passed to the handler. Without this option, the header is
+// neither read nor removed.
+func MWExtractInProcess() MWOption {
+	return func(options *mwOptions) {
+		options.inProcess = true
+	}
+}
+
+// MWLogRedirectLocation returns a MWOption that logs the Location header
+// of 3xx responses as a "redirect" event on the server-side span. The
+// location is passed through the http.url tag function, so it is redacted
+// the same way as the request URL.
+func MWLogRedirectLocation() MWOption {
+	return func(options *mwOptions) {
+		options.logRedirect = true
+	}
+}
+
 // Middleware wraps an http.Handler and traces incoming requests.
 // Additionally, it adds the span to the request's context.
 //
 // By default, the operation name of the spans is set to "HTTP {method}".
 // This can be overridden with options.
 //
+// The span is finished when the handler returns. Writes to the
+// ResponseWriter made after that, eg by a goroutine leaked by the handler,
+// are not reflected in the span.
+//
 // Example:
 //
 //	http.ListenAndServe("localhost:80", nethttp.Middleware(tracer, http.DefaultServeMux))
@@ -107,53 +967,335 @@ func MiddlewareFunc(tr opentracing.Tracer, h http.HandlerFunc, options ...MWOpti
 		},
 		spanFilter:   func(r *http.Request) bool { return true },
 		spanObserver: func(span opentracing.Span, r *http.Request) {},
-		urlTagFunc: func(u *url.URL) string {
-			return u.String()
-		},
+		hashLimit:    64 << 10,
 	}
 	for _, opt := range options {
 		opt(&opts)
 	}
+	if opts.urlTagFunc == nil {
+		opts.urlTagFunc = func(u *url.URL) string {
+			return u.String()
+		}
+		if opts.stripQuery {
+			opts.urlTagFunc = urlWithoutQuery
+		}
+	}
 	// set component name, use "net/http" if caller does not specify
 	componentName := opts.componentName
 	if componentName == "" {
 		componentName = defaultComponentName
 	}
 
+	var handlerName string
+	if opts.tagHandler {
+		if f := runtime.FuncForPC(reflect.ValueOf(h).Pointer()); f != nil {
+			handlerName = f.Name()
+		}
+	}
+
+	var inflight int64
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		if !opts.spanFilter(r) {
+		var inflightAtStart int64
+		if opts.inflight {
+			inflightAtStart = atomic.AddInt64(&inflight, 1)
+			defer atomic.AddInt64(&inflight, -1)
+		}
+		var inProcessKey string
+		if opts.inProcess {
+			inProcessKey, r = takeInProcessKey(r)
+		}
+		if !opts.spanFilter(r) || isProbe(r, opts.probeAgents) {
+			h(w, r)
+			return
+		}
+		start := time.Now()
+		ctx := extractSpanContext(tr, r, inProcessKey, &opts)
+		if opts.sample && !sampled(ctx, opts.sampleRate, opts.traceIDFunc) {
 			h(w, r)
 			return
 		}
-		ctx, _ := tr.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
-		sp := tr.StartSpan(opts.opNameFunc(r), ext.RPCServerOption(ctx))
+		startOpts := []opentracing.StartSpanOption{ext.RPCServerOption(ctx), opentracing.StartTime(start)}
+		for _, prefix := range opts.priorityPaths {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				startOpts = append(startOpts, opentracing.Tag{Key: string(ext.SamplingPriority), Value: uint16(1)})
+				break
+			}
+		}
+		var effectiveMethod string
+		if opts.overrideName != "" {
+			effectiveMethod = strings.ToUpper(r.Header.Get(opts.overrideName))
+		}
+		sp := tr.StartSpan(operationName(r, effectiveMethod, &opts), startOpts...)
 		ext.HTTPMethod.Set(sp, r.Method)
-		ext.HTTPUrl.Set(sp, opts.urlTagFunc(r.URL))
+		if effectiveMethod != "" {
+			sp.SetTag("http.method_effective", effectiveMethod)
+		}
+		setURLTag(sp, opts.urlTagFunc(r.URL), opts.maxURLLength)
 		ext.Component.Set(sp, componentName)
+		if opts.inflight {
+			sp.SetTag("http.server.inflight_at_start", inflightAtStart)
+		}
+		if opts.sniTag && r.TLS != nil && r.TLS.ServerName != "" {
+			sp.SetTag("tls.sni", r.TLS.ServerName)
+		}
+		if opts.clientCert {
+			tagClientCert(sp, r.TLS)
+		}
+		if opts.headerBytes {
+			sp.SetTag("http.request_header_bytes", headerSize(r.Header))
+		}
+		if opts.upgradeTag && hasToken(r.Header, "Connection", "upgrade") {
+			if upgrade := r.Header.Get("Upgrade"); upgrade != "" {
+				sp.SetTag("http.upgrade", upgrade)
+			}
+		}
+		if opts.authScheme {
+			if scheme := authScheme(r.Header.Get("Authorization")); scheme != "" {
+				sp.SetTag("http.auth_scheme", scheme)
+			}
+		}
+		if opts.baggagePrefix != "" {
+			tagBaggage(sp, opts.baggagePrefix)
+		}
+		if opts.urlLengths {
+			sp.SetTag("http.path_length", len(r.URL.Path))
+			sp.SetTag("http.query_length", len(r.URL.RawQuery))
+		}
+		if opts.queryCount {
+			sp.SetTag("http.query_param_count", len(r.URL.Query()))
+		}
+		if opts.cookieNames {
+			var names []string
+			for _, c := range r.Cookies() {
+				names = append(names, c.Name)
+			}
+			if len(names) > 0 {
+				sp.SetTag("http.request.cookie_names", joinNames(names))
+			}
+		}
+		if opts.tenantHeader != "" {
+			if tenant := r.Header.Get(opts.tenantHeader); tenant != "" {
+				sp.SetTag("http.tenant", tenant)
+				if opts.validTenant != nil && !opts.validTenant(tenant) {
+					sp.SetTag("http.tenant_invalid", true)
+				}
+			}
+		}
+		if opts.userAgentTag {
+			tagUserAgent(sp, r.UserAgent(), opts.userAgentFunc)
+		}
+		if name := handlerNameFor(r, handlerName, &opts); name != "" {
+			sp.SetTag("http.handler", name)
+		}
+		if acceptTime, ok := r.Context().Value(keyAcceptTime).(time.Time); ok {
+			delay := start.Sub(acceptTime).Milliseconds()
+			sp.SetTag("http.server.queue_time_ms", delay)
+			if opts.acceptDelay {
+				sp.SetTag("http.server.accept_delay_ms", delay)
+			}
+		}
+		if addr, ok := r.Context().Value(keyServerAddr).(string); ok {
+			tagServerAddr(sp, addr)
+		}
+		if opts.http2StreamID && r.ProtoMajor == 2 {
+			if id, ok := r.Context().Value(keyHTTP2StreamID).(uint32); ok {
+				sp.SetTag("http2.stream_id", id)
+			}
+		}
+		if opts.attemptHeader != "" {
+			if attempt, err := strconv.Atoi(r.Header.Get(opts.attemptHeader)); err == nil && attempt >= 0 {
+				sp.SetTag("http.request.attempt", attempt)
+			}
+		}
+		var requestID string
+		if opts.requestIDName != "" {
+			requestID = r.Header.Get(opts.requestIDName)
+			if requestID == "" {
+				requestID = opts.genRequestID()
+				w.Header().Set(opts.requestIDName, requestID)
+			}
+			sp.SetTag("http.request_id", requestID)
+		}
+		budget, hasBudget := requestBudget(r, &opts)
+		if hasBudget {
+			sp.SetTag("http.server.deadline_ms", budget.Milliseconds())
+		}
 		opts.spanObserver(sp, r)
 
 		mt := &metricsTracker{ResponseWriter: w}
+		if opts.trackPushes {
+			mt.onPush = func(target string, err error) {
+				fields := []log.Field{log.String("event", "push"), log.String("target", target)}
+				if err != nil {
+					fields = append(fields, log.Error(err))
+				}
+				sp.LogFields(fields...)
+			}
+		}
 		r = r.WithContext(opentracing.ContextWithSpan(r.Context(), sp))
+		if requestID != "" {
+			r = r.WithContext(context.WithValue(r.Context(), keyRequestID, requestID))
+		}
+		var handlerErr *handlerErrorHolder
+		if opts.handlerError {
+			handlerErr = &handlerErrorHolder{}
+			r = r.WithContext(context.WithValue(r.Context(), keyHandlerError, handlerErr))
+		}
+		var sizer *uncompressedSizerHolder
+		if opts.uncompressed {
+			sizer = &uncompressedSizerHolder{}
+			r = r.WithContext(context.WithValue(r.Context(), keyUncompressedSizer, sizer))
+		}
+		var body *serverRequestBody
+		if (opts.fingerprint != "" || opts.requestSize) && r.Body != nil && r.Body != http.NoBody {
+			body = &serverRequestBody{ReadCloser: r.Body, timed: opts.requestSize}
+			if opts.fingerprint != "" {
+				body.hash = sha256.New()
+				body.hashLimit = opts.hashLimit
+			}
+			r.Body = body
+		}
+		if hasBudget && opts.deadlineCtx {
+			ctx, cancel := context.WithTimeout(r.Context(), budget)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
 
 		defer func() {
 			panicErr := recover()
 			didPanic := panicErr != nil
+			if didPanic && opts.panicSpan {
+				panicSpan(tr, sp, panicErr)
+			}
 
-			if mt.status == 0 && !didPanic {
+			status, size := mt.snapshot()
+			if status == 0 && !didPanic {
 				// Standard behavior of http.Server is to assume status code 200 if one was not written by a handler that returned successfully.
 				// https://github.com/golang/go/blob/fca286bed3ed0e12336532cc711875ae5b3cb02a/src/net/http/server.go#L120
-				mt.status = 200
+				status = 200
+			}
+			if status > 0 {
+				ext.HTTPStatusCode.Set(sp, uint16(status)) //nolint:gosec // can't have integer overflow with status code
+			}
+			if opts.statusText {
+				if text := http.StatusText(status); text != "" {
+					sp.SetTag("http.status_text", text)
+				}
+			}
+			if size > 0 {
+				sp.SetTag(responseSizeKey, size)
+			}
+			if sizer != nil {
+				if n, ok := sizer.size(); ok {
+					sp.SetTag("http.response_uncompressed_size", n)
+				}
+			}
+			if body != nil {
+				if encoding := r.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+					sp.SetTag("http.request.content_encoding", encoding)
+				}
+				if digest, ok := body.fingerprint(); ok {
+					sp.SetTag(opts.fingerprint, digest)
+				}
+				if opts.requestSize {
+					n := body.size()
+					sp.SetTag(requestSizeKey, int(n))
+					if r.ContentLength >= 0 && n != r.ContentLength {
+						sp.SetTag("http.request.size_mismatch", true)
+					}
+					sp.SetTag("http.server.body_read_ms", body.blockedTime().Milliseconds())
+					if eof, ok := body.readAt(); ok {
+						sp.SetTag("http.server.process_time_ms", time.Since(eof).Milliseconds())
+					}
+				}
+			}
+			if opts.trackPushes {
+				if pushes := mt.pushCount(); pushes > 0 {
+					sp.SetTag("http2.pushes", pushes)
+				}
+			}
+			if opts.streamingTag {
+				if flushes := mt.flushCount(); flushes > 0 {
+					sp.SetTag("http.streaming", true)
+					sp.SetTag("http.flushes", flushes)
+				}
+			}
+			if opts.cacheHeader != "" {
+				tagCacheStatus(sp, mt.Header().Get(opts.cacheHeader))
+			}
+			if opts.setCookies {
+				var names []string
+				for _, v := range mt.Header().Values("Set-Cookie") {
+					if i := strings.IndexByte(v, '='); i > 0 {
+						names = append(names, strings.TrimSpace(v[:i]))
+					}
+				}
+				if len(names) > 0 {
+					sp.SetTag("http.response.set_cookie_names", joinNames(names))
+				}
+			}
+			if opts.conditional && isConditional(r) {
+				switch status {
+				case http.StatusNotModified:
+					sp.SetTag("http.conditional", "hit")
+				case http.StatusPreconditionFailed:
+					sp.SetTag("http.conditional", "miss")
+				}
+			}
+			if opts.varyTag {
+				if vary := mt.Header().Values("Vary"); len(vary) > 0 {
+					sp.SetTag("http.response.vary", strings.Join(vary, ", "))
+				}
+			}
+			if opts.routePattern {
+				tagRoutePattern(sp, r.Method, requestPattern(r))
+			}
+			if opts.routeFunc != nil {
+				if pattern := opts.routeFunc(r); pattern != "" {
+					tagRoutePattern(sp, r.Method, pattern)
+				}
+			}
+			if opts.finishOpName != nil {
+				if name := opts.finishOpName(r, status); name != "" {
+					sp.SetOperationName(name)
+				}
 			}
-			if mt.status > 0 {
-				ext.HTTPStatusCode.Set(sp, uint16(mt.status)) //nolint:gosec // can't have integer overflow with status code
+			if opts.logRedirect && status >= 300 && status < 400 {
+				logRedirectLocation(sp, mt.Header().Get("Location"), opts.urlTagFunc)
 			}
-			if mt.size > 0 {
-				sp.SetTag(responseSizeKey, mt.size)
+			var err error
+			if handlerErr != nil {
+				err = handlerErr.err
 			}
-			if mt.status >= http.StatusInternalServerError || didPanic {
+			if status >= http.StatusInternalServerError || didPanic || err != nil {
 				ext.Error.Set(sp, true)
 			}
-			sp.Finish()
+			if errType := serverErrorType(didPanic, status, r.Context().Err(), err); errType != "" {
+				sp.SetTag("error.type", errType)
+			}
+			if opts.outcomeTag {
+				sp.SetTag("http.outcome", outcome(didPanic, status, err))
+			}
+			if len(opts.latencyBounds) > 0 {
+				sp.SetTag("http.latency_bucket", latencyBucket(time.Since(start), opts.latencyBounds))
+			}
+			if opts.sampledFunc != nil {
+				if isSampled, known := opts.sampledFunc(sp); known {
+					sp.SetTag("sampling.sampled", isSampled)
+				}
+			}
+			if opts.afterFlush && !didPanic && mt.flushCount() > 0 {
+				// Flush what the handler left buffered, so that the span
+				// ends with the final flush of the response.
+				if fl, ok := mt.ResponseWriter.(http.Flusher); ok {
+					fl.Flush()
+				}
+			}
+			if opts.finishOptions != nil {
+				sp.FinishWithOptions(opts.finishOptions(r, status))
+			} else {
+				sp.Finish()
+			}
 
 			if didPanic {
 				panic(panicErr)
@@ -164,3 +1306,359 @@ func MiddlewareFunc(tr opentracing.Tracer, h http.HandlerFunc, options ...MWOpti
 	}
 	return http.HandlerFunc(fn)
 }
+
+// MiddlewareForErrHandler wraps a handler that returns an error, as used
+// by frameworks like echo, and traces incoming requests as Middleware
+// does. When h returns an error, the span is marked as failed and the
+// error is logged on it, in addition to the tags derived from the
+// response. The error.type tag is set to "handler_error", and the
+// http.outcome tag to "server_error" if the status code is below 400,
+// unless the response or a panic give a more specific classification.
+// Writing an error response remains up to h.
+//
+// Example:
+//
+//	handler := nethttp.MiddlewareForErrHandler(tracer, func(w http.ResponseWriter, r *http.Request) error {
+//		return json.NewEncoder(w).Encode(customers)
+//	})
+func MiddlewareForErrHandler(tr opentracing.Tracer, h func(http.ResponseWriter, *http.Request) error, options ...MWOption) http.Handler {
+	options = append(options, func(options *mwOptions) {
+		options.handlerError = true
+	})
+	return MiddlewareFunc(tr, func(w http.ResponseWriter, r *http.Request) {
+		err := h(w, r)
+		if err == nil {
+			return
+		}
+		if holder, ok := r.Context().Value(keyHandlerError).(*handlerErrorHolder); ok {
+			holder.err = err
+		}
+		if sp := opentracing.SpanFromContext(r.Context()); sp != nil {
+			sp.LogFields(log.String("event", "error"), log.Error(err))
+		}
+	}, options...)
+}
+
+// handlerErrorHolder carries the error returned by the handler wrapped by
+// MiddlewareForErrHandler to the middleware, through the request context.
+type handlerErrorHolder struct {
+	err error
+}
+
+// isProbe reports whether the User-Agent of r starts with one of agents.
+func isProbe(r *http.Request, agents []string) bool {
+	userAgent := r.UserAgent()
+	for _, agent := range agents {
+		if strings.HasPrefix(userAgent, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// isConditional reports whether r has a precondition header.
+func isConditional(r *http.Request) bool {
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// authScheme returns the scheme of the Authorization header value v, or
+// "" if v does not have credentials after the scheme.
+func authScheme(v string) string {
+	v = strings.TrimSpace(v)
+	i := strings.IndexByte(v, ' ')
+	if i <= 0 {
+		return ""
+	}
+	return v[:i]
+}
+
+// operationName returns the operation name of the span for r, computed
+// with the effective method if it is set and MWMethodOverrideOperationName
+// is enabled.
+func operationName(r *http.Request, effectiveMethod string, opts *mwOptions) string {
+	if !opts.overrideOp || effectiveMethod == "" {
+		return opts.opNameFunc(r)
+	}
+	override := *r
+	override.Method = effectiveMethod
+	return opts.opNameFunc(&override)
+}
+
+// extractSpanContext extracts the parent span context of r, trying the
+// span context handed over by InProcessTransport under inProcessKey, the
+// HTTP headers and then the formats enabled by the options.
+func extractSpanContext(tr opentracing.Tracer, r *http.Request, inProcessKey string, opts *mwOptions) opentracing.SpanContext {
+	if opts.inProcess {
+		if ctx, ok := inProcessSpanContext(inProcessKey); ok {
+			return ctx
+		}
+	}
+	ctx, err := tr.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	if err == nil {
+		return ctx
+	}
+	if opts.b3Single {
+		if h, ok := b3HeadersFromSingle(r.Header.Get(b3SingleHeader)); ok {
+			// Keep the other headers, such as baggage, visible to the
+			// tracer.
+			for k, v := range r.Header {
+				if _, ok := h[k]; !ok {
+					h[k] = v
+				}
+			}
+			if b3Ctx, err := tr.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(h)); err == nil {
+				return b3Ctx
+			}
+		}
+	}
+	if opts.binaryHeader == "" {
+		return ctx
+	}
+	if v := r.Header.Get(opts.binaryHeader); v != "" {
+		if b, err := base64.StdEncoding.DecodeString(v); err == nil {
+			if binCtx, err := tr.Extract(opentracing.Binary, bytes.NewReader(b)); err == nil {
+				return binCtx
+			}
+		}
+	}
+	return ctx
+}
+
+func tagClientCert(sp opentracing.Span, state *tls.ConnectionState) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	sp.SetTag("tls.client.subject", cert.Subject.String())
+	sp.SetTag("tls.client.issuer", cert.Issuer.String())
+	if cert.SerialNumber != nil {
+		sp.SetTag("tls.client.serial", cert.SerialNumber.String())
+	}
+}
+
+// tagUserAgent records userAgent, normalized if normalize is set, as the
+// http.user_agent tag.
+func tagUserAgent(sp opentracing.Span, userAgent string, normalize func(string) string) {
+	if userAgent != "" && normalize != nil {
+		userAgent = normalize(userAgent)
+	}
+	if userAgent != "" {
+		sp.SetTag("http.user_agent", userAgent)
+	}
+}
+
+// joinNames returns the distinct names, sorted and comma separated.
+func joinNames(names []string) string {
+	sort.Strings(names)
+	distinct := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			distinct = append(distinct, name)
+		}
+	}
+	return strings.Join(distinct, ",")
+}
+
+// latencyBucket returns the label of the bucket d falls in, given the
+// sorted bounds of the buckets.
+func latencyBucket(d time.Duration, bounds []time.Duration) string {
+	if d < bounds[0] {
+		return "<" + bounds[0].String()
+	}
+	for i := 1; i < len(bounds); i++ {
+		if d < bounds[i] {
+			return bounds[i-1].String() + "-" + bounds[i].String()
+		}
+	}
+	return ">=" + bounds[len(bounds)-1].String()
+}
+
+// serverErrorType classifies the outcome of a request for the error.type
+// tag, or returns an empty string if the request succeeded. handlerErr is
+// the error returned by a handler wrapped by MiddlewareForErrHandler.
+func serverErrorType(didPanic bool, status int, ctxErr, handlerErr error) string {
+	switch {
+	case didPanic:
+		return "panic"
+	case errors.Is(ctxErr, context.Canceled):
+		return "client_disconnect"
+	case errors.Is(ctxErr, context.DeadlineExceeded):
+		return "timeout"
+	case status >= http.StatusInternalServerError:
+		return "server_error"
+	case handlerErr != nil:
+		return "handler_error"
+	}
+	return ""
+}
+
+// panicSpan records the recovered value v as a "panic" child span of sp.
+// It must be called from the deferred function that recovered v, so that
+// the stack is the one of the panic.
+func panicSpan(tr opentracing.Tracer, sp opentracing.Span, v interface{}) {
+	child := tr.StartSpan("panic", opentracing.ChildOf(sp.Context()))
+	ext.Error.Set(child, true)
+	child.LogFields(
+		log.String("event", "panic"),
+		log.String("panic.value", fmt.Sprint(v)),
+		log.String("stack", string(debug.Stack())),
+	)
+	child.Finish()
+}
+
+// sampled reports whether a request with the parent span context ctx is
+// sampled at rate, see MWConsistentSample.
+func sampled(ctx opentracing.SpanContext, rate float64, traceID func(opentracing.SpanContext) uint64) bool {
+	switch {
+	case rate >= 1:
+		return true
+	case rate <= 0:
+		return false
+	}
+	var h uint64
+	if ctx != nil && traceID != nil {
+		h = traceID(ctx)
+	}
+	if h == 0 {
+		return rand.Float64() < rate //nolint:gosec // sampling does not need a secure random source
+	}
+	// SplitMix64 finalizer, to spread sequential or otherwise structured
+	// trace IDs over the whole range.
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	h ^= h >> 31
+	return h < uint64(rate*math.MaxUint64)
+}
+
+// outcome classifies a response for the http.outcome tag. A handler error
+// turns an otherwise successful response into a server error.
+func outcome(didPanic bool, status int, handlerErr error) string {
+	switch {
+	case didPanic || status >= http.StatusInternalServerError:
+		return "server_error"
+	case status >= http.StatusBadRequest:
+		return "client_error"
+	case handlerErr != nil:
+		return "server_error"
+	}
+	return "success"
+}
+
+func tagServerAddr(sp opentracing.Span, addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	if host != "" {
+		sp.SetTag("net.host.name", host)
+	}
+	if p, err := strconv.Atoi(port); err == nil {
+		sp.SetTag("net.host.port", p)
+	}
+}
+
+// handlerNameFor returns the handler name of r, preferring the name
+// returned by the MWHandlerNameFunc function over defaultName.
+func handlerNameFor(r *http.Request, defaultName string, opts *mwOptions) string {
+	if opts.handlerName != nil {
+		if name := opts.handlerName(r); name != "" {
+			return name
+		}
+	}
+	return defaultName
+}
+
+// newRequestID returns a random request ID of 32 hexadecimal digits.
+func newRequestID() string {
+	return fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64()) //nolint:gosec // request IDs only need to be unique
+}
+
+// requestBudget returns the time budget carried by the deadline header
+// configured with MWDeadlineHeader.
+func requestBudget(r *http.Request, opts *mwOptions) (time.Duration, bool) {
+	if opts.deadlineName == "" {
+		return 0, false
+	}
+	v := r.Header.Get(opts.deadlineName)
+	if v == "" {
+		return 0, false
+	}
+	d, err := opts.parseDeadline(v)
+	if err != nil {
+		return 0, false
+	}
+	return d, true
+}
+
+// setURLTag sets the http.url tag to u, truncated to maxLength runes
+// when maxLength is positive.
+func setURLTag(sp opentracing.Span, u string, maxLength int) {
+	if t := truncateURL(u, maxLength); t != u {
+		u = t
+		sp.SetTag("http.url_truncated", true)
+	}
+	ext.HTTPUrl.Set(sp, u)
+}
+
+// truncateURL truncates u to maxLength runes, if maxLength is positive.
+func truncateURL(u string, maxLength int) string {
+	if maxLength > 0 && utf8.RuneCountInString(u) > maxLength {
+		return string([]rune(u)[:maxLength]) + "..."
+	}
+	return u
+}
+
+// tagRoutePattern sets the route tags and operation name of sp from a
+// pattern of the form "[METHOD ][HOST]/[PATH]". The operation name of a
+// pattern without a method is prefixed with method, the method of the
+// request.
+func tagRoutePattern(sp opentracing.Span, method, pattern string) {
+	if pattern == "" {
+		return
+	}
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		method, pattern = pattern[:i], strings.TrimLeft(pattern[i+1:], " \t")
+	}
+	route := pattern
+	if i := strings.IndexByte(pattern, '/'); i > 0 {
+		sp.SetTag("http.route_host", pattern[:i])
+		route = pattern[i:]
+	}
+	sp.SetTag("http.route", route)
+	sp.SetOperationName(method + " " + route)
+}
+
+// urlWithoutQuery formats u without its query string and fragment.
+func urlWithoutQuery(u *url.URL) string {
+	stripped := *u
+	stripped.RawQuery = ""
+	stripped.ForceQuery = false
+	stripped.Fragment = ""
+	return stripped.String()
+}
+
+func tagCacheStatus(sp opentracing.Span, status string) {
+	v := strings.ToUpper(status)
+	hit := strings.HasPrefix(v, "HIT")
+	if !hit && !strings.HasPrefix(v, "MISS") {
+		return
+	}
+	sp.SetTag("http.cache_status", status)
+	sp.SetTag("http.cache_hit", hit)
+}
+
+func logRedirectLocation(sp opentracing.Span, location string, urlTagFunc func(u *url.URL) string) {
+	if location == "" {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return
+	}
+	sp.LogFields(log.String("event", "redirect"), log.String("location", urlTagFunc(u)))
+}
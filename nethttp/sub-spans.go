@@ -0,0 +1,59 @@
+//go:build go1.7
+// +build go1.7
+
+package nethttp
+
+import (
+	"sync"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// subSpans holds the child spans of a per-request span that model the
+// phases of the request reported by the httptrace hooks. The hooks may be
+// called from other goroutines than the one running the request, and some
+// phases, like connecting to the addresses of a host, may run in
+// parallel, so spans are keyed by phase and address.
+type subSpans struct {
+	open map[string]opentracing.Span
+	mu   sync.Mutex
+}
+
+// start starts a span named operationName as a child of parent, with the
+// tracer of parent, and registers it under key. The spans started under
+// the no-op span of a skipped hop are therefore no-op spans as well.
+func (s *subSpans) start(parent opentracing.Span, key, operationName string) opentracing.Span {
+	sp := parent.Tracer().StartSpan(operationName, opentracing.ChildOf(parent.Context()))
+	s.mu.Lock()
+	if s.open == nil {
+		s.open = make(map[string]opentracing.Span)
+	}
+	s.open[key] = sp
+	s.mu.Unlock()
+	return sp
+}
+
+// end unregisters and returns the span registered under key, or nil if
+// there is none. The caller is responsible for finishing it.
+func (s *subSpans) end(key string) opentracing.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, ok := s.open[key]
+	if !ok {
+		return nil
+	}
+	delete(s.open, key)
+	return sp
+}
+
+// finishAll finishes the spans whose phase never completed, eg because
+// the request was canceled.
+func (s *subSpans) finishAll() {
+	s.mu.Lock()
+	open := s.open
+	s.open = nil
+	s.mu.Unlock()
+	for _, sp := range open {
+		sp.Finish()
+	}
+}